@@ -0,0 +1,204 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ajanata/fanotify/db"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	blockMsg = `Send me the name of the artist you never want to hear about again. It doesn't matter if you don't get the case right.
+
+Or, you can send /cancel to cancel blocking an artist.`
+
+	unblockMsgSuffix = `
+
+Please send the artist you want to unblock.
+
+Or, you can send /cancel to cancel unblocking an artist.`
+
+	noBlockedArtistsMsg = "You haven't blocked any artists."
+
+	// Telegram limits how much callback data a button can have, and the block button has to fit the artist's name in it
+	maxCallbackDataLength = 64
+)
+
+// blockKeyboard makes the button to block the artist an alert is about. It is nil if there isn't one, or if their name
+// won't fit in the button's callback data.
+func blockKeyboard(artist string) interface{} {
+	if artist == "" {
+		return nil
+	}
+	data := strings.Join([]string{callbackBlock, "", strings.ToLower(artist)}, ":")
+	if len(data) > maxCallbackDataLength {
+		return nil
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(buttonText("Block "+artist), data)))
+}
+
+// cmdBlock blocks the artist given as the command's arguments, or asks for the artist if there weren't any.
+func (b *bot) cmdBlock(u *tgbotapi.User, args string) {
+	if !b.userStartedBot(u.ID) {
+		return
+	}
+
+	if args != "" {
+		b.blockArtist(u, args)
+		return
+	}
+
+	b.plaintextHandler[u.ID] = b.blockArtistCallback
+	b.sendMessage(u.ID, blockMsg)
+}
+
+func (b *bot) blockArtistCallback(m *tgbotapi.Message) {
+	b.blockArtist(m.From, m.Text)
+}
+
+func (b *bot) blockArtist(u *tgbotapi.User, artist string) {
+	artist = strings.TrimSpace(artist)
+	if !faUsernameRegexp.MatchString(artist) {
+		b.sendHTMLMessage(u.ID, "<code>%s</code> isn't a FurAffinity username.", escapeHTML("%s", artist))
+		return
+	}
+
+	blocked, err := b.setBlocked(u, artist, true)
+	switch {
+	case err != nil:
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "block"))
+	case !blocked:
+		b.sendHTMLMessage(u.ID, "You already blocked <code>%s</code>.", escapeHTML("%s", artist))
+	default:
+		b.sendHTMLMessage(u.ID, "I won't alert you about anything from <code>%s</code> anymore. "+
+			"Send /unblock to undo this.", escapeHTML("%s", artist))
+	}
+}
+
+// cmdUnblock unblocks the artist given as the command's arguments, or lists the user's blocked artists and asks which
+// to unblock if there weren't any.
+func (b *bot) cmdUnblock(u *tgbotapi.User, args string) {
+	if !b.userStartedBot(u.ID) {
+		return
+	}
+
+	if args != "" {
+		b.unblockArtist(u, args)
+		return
+	}
+
+	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
+	if err != nil || user == nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":     "cmdUnblock",
+			"userID":   u.ID,
+			"username": u.UserName,
+		}).Error("Could not load user")
+		b.sendMessage(u.ID, loadFailedFormat, "your blocked artists")
+		return
+	}
+	if len(user.BlockedArtists) == 0 {
+		b.sendMessage(u.ID, noBlockedArtistsMsg)
+		return
+	}
+
+	msg := "You have blocked these artists:\n"
+	for _, artist := range sortedKeys(user.BlockedArtists) {
+		msg += "\n<code>" + escapeHTML("%s", artist) + "</code>"
+	}
+	b.plaintextHandler[u.ID] = b.unblockArtistCallback
+	b.sendHTMLMessage(u.ID, msg+unblockMsgSuffix)
+}
+
+func (b *bot) unblockArtistCallback(m *tgbotapi.Message) {
+	b.unblockArtist(m.From, m.Text)
+}
+
+func (b *bot) unblockArtist(u *tgbotapi.User, artist string) {
+	artist = strings.TrimSpace(artist)
+	unblocked, err := b.setBlocked(u, artist, false)
+	switch {
+	case err != nil:
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "unblock"))
+	case !unblocked:
+		b.sendHTMLMessage(u.ID, "You haven't blocked <code>%s</code>.", escapeHTML("%s", artist))
+	default:
+		b.sendHTMLMessage(u.ID, "You'll get alerts about <code>%s</code> again.", escapeHTML("%s", artist))
+	}
+}
+
+// setBlocked blocks or unblocks the artist for the user, returning whether that changed anything.
+func (b *bot) setBlocked(u *tgbotapi.User, artist string, block bool) (bool, error) {
+	artist = strings.ToLower(artist)
+	var changed bool
+	err := b.db.UpdateTGUser(db.TelegramID(u.ID), func(user *db.TGUser) error {
+		changed = user.BlockedArtists[artist] != block
+		if block {
+			if user.BlockedArtists == nil {
+				user.BlockedArtists = make(map[string]bool)
+			}
+			user.BlockedArtists[artist] = true
+		} else {
+			delete(user.BlockedArtists, artist)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":     "setBlocked",
+			"userID":   u.ID,
+			"username": u.UserName,
+			"artist":   artist,
+			"block":    block,
+		}).Error("Unable to save blocked artists for user")
+	}
+	return changed, err
+}
+
+func (b *bot) callbackBlock(q *tgbotapi.CallbackQuery, artist string) {
+	if !faUsernameRegexp.MatchString(artist) {
+		b.answerCallback(q, "Sorry, I don't know what to do with that button.")
+		return
+	}
+
+	blocked, err := b.setBlocked(q.From, artist, true)
+	switch {
+	case err != nil:
+		b.answerCallback(q, fmt.Sprintf(saveFailedFormat, "block"))
+	case !blocked:
+		b.answerCallback(q, "You already blocked "+artist+".")
+	default:
+		b.answerCallback(q, "Blocked "+artist+". Send /unblock to undo this.")
+	}
+}
@@ -30,8 +30,11 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/ajanata/faapi"
 	"github.com/ajanata/fanotify/db"
@@ -47,23 +50,30 @@ type (
 		tg               *tgbotapi.BotAPI
 		plaintextHandler map[int]ptHandler
 		shouldQuit       chan struct{}
+		stopOnce         sync.Once
+		// shutdownDeadline is closed when background jobs have run out of time to finish after being told to quit.
+		shutdownDeadline chan struct{}
 		backgroundJobs   sync.WaitGroup
-		pollTimer        *time.Ticker
-		// submission and journal IDs are probably in different namespaces but their current IDs are far enough apart
-		userAlertedForID map[int]map[int64]bool
-		userAlertedMutex sync.Mutex
+		scheduler        *scheduler
+		// outboxReady wakes up the sender when an alert is queued.
+		outboxReady chan struct{}
+		// sendPausedUntil is set by the sender when Telegram tells us to slow down.
+		sendPausedUntil time.Time
+		sendLimiter     *sendLimiter
+		// replies are messages waiting to be sent to each user by their reply sender, which exists while they have any.
+		replies      map[int][]tgbotapi.Chattable
+		repliesMutex sync.Mutex
+		// pendingTestSearches is the most recent /testsearch for each user, so it can be added with a button.
+		pendingTestSearches      map[int]string
+		pendingTestSearchesMutex sync.Mutex
 	}
 
 	ptHandler func(message *tgbotapi.Message)
 )
 
 const (
-	searchResultTemplate = `<b>Search:</b> <code>%s</code>: %s
-
-by %s (%s)
-https://www.furaffinity.net/view/%d/`
-
-	submissionTemplate = `<b>Submission:</b> %s
+	// submissionTemplate follows the list of triggers that found the submission.
+	submissionTemplate = `%s
 
 by %s (%s)
 https://www.furaffinity.net/view/%d/`
@@ -72,6 +82,15 @@ https://www.furaffinity.net/view/%d/`
 
 by %s
 https://www.furaffinity.net/journal/%d/`
+
+	defaultDeliveredTTL    = 30 * 24 * time.Hour
+	defaultShutdownTimeout = 30 * time.Second
+	// maxCaptionLength is how long the caption of an uploaded photo can be.
+	maxCaptionLength = 200
+	// minTriggerCrop is the shortest a trigger's name is cropped to before it isn't worth showing.
+	minTriggerCrop         = 10
+	replyDrainInterval     = 100 * time.Millisecond
+	deliveredPruneInterval = time.Hour
 )
 
 func newBot(c *Config, d db.DB, fa *faapi.Client, tg *tgbotapi.BotAPI) *bot {
@@ -81,24 +100,31 @@ func newBot(c *Config, d db.DB, fa *faapi.Client, tg *tgbotapi.BotAPI) *bot {
 		panic(err)
 	}
 
-	return &bot{
-		c:                c,
-		db:               d,
-		fa:               fa,
-		tg:               tg,
-		plaintextHandler: make(map[int]ptHandler),
-		shouldQuit:       make(chan struct{}),
-		pollTimer:        time.NewTicker(pi),
-		userAlertedForID: make(map[int]map[int64]bool),
+	b := &bot{
+		c:                   c,
+		db:                  d,
+		fa:                  fa,
+		tg:                  tg,
+		plaintextHandler:    make(map[int]ptHandler),
+		shouldQuit:          make(chan struct{}),
+		shutdownDeadline:    make(chan struct{}),
+		outboxReady:         make(chan struct{}, 1),
+		sendLimiter:         newSendLimiter(&c.TG),
+		replies:             make(map[int][]tgbotapi.Chattable),
+		pendingTestSearches: make(map[int]string),
 	}
+	b.scheduler = newScheduler(b, pi, c.FA.PollWorkers)
+	return b
 }
 
 func (b *bot) run() {
 	logger := log.WithField("func", "run")
 
-	defer b.pollTimer.Stop()
-	b.backgroundJobs.Add(1)
+	b.backgroundJobs.Add(4)
 	go b.poller()
+	go b.deliveredPruner()
+	go b.sender()
+	go b.digestSender()
 
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
@@ -111,8 +137,15 @@ func (b *bot) run() {
 	for {
 		select {
 		case <-b.shouldQuit:
+			b.tg.StopReceivingUpdates()
+			b.waitForBackgroundJobs()
 			return
 		case update := <-updates:
+			if update.CallbackQuery != nil {
+				b.dispatchCallback(update.CallbackQuery)
+				break
+			}
+
 			if update.Message == nil {
 				logger.WithField("update", update).Error("Update does not contain a message")
 				break
@@ -127,114 +160,247 @@ func (b *bot) run() {
 			if update.Message.IsCommand() {
 				b.dispatchCommand(update.Message)
 			} else if handler, exists := b.plaintextHandler[update.Message.From.ID]; exists {
-				handler(update.Message)
+				// handlers can ask for another message by setting a new handler
 				delete(b.plaintextHandler, update.Message.From.ID)
+				handler(update.Message)
 			}
 		}
 	}
 }
 
-func (b *bot) poller() {
-	defer logPanic()
-	defer b.backgroundJobs.Done()
-	// fire it once at the start
-	b.processJobs()
+// stop tells the bot to shut down. It is safe to call more than once, and from any goroutine.
+func (b *bot) stop() {
+	b.stopOnce.Do(func() {
+		timeout := b.c.ShutdownTimeout.convert()
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		log.WithField("timeout", timeout).Warn("Shutting bot down.")
 
-	for {
-		select {
-		case <-b.shouldQuit:
-			log.Info("stopping poller")
-			return
-		case <-b.pollTimer.C:
-			b.processJobs()
+		close(b.shouldQuit)
+		time.AfterFunc(timeout, func() {
+			close(b.shutdownDeadline)
+		})
+	})
+}
+
+// runInBackground runs the job in its own goroutine, counted with the other background jobs so that shutdown waits for
+// it to finish before closing the database. Only the update loop starts jobs, and it has stopped by the time shutdown
+// waits, so they can't be added too late.
+func (b *bot) runInBackground(job func()) {
+	b.backgroundJobs.Add(1)
+	go func() {
+		defer b.backgroundJobs.Done()
+		job()
+	}()
+}
+
+// waitForBackgroundJobs waits for the background goroutines to finish, or for the shutdown deadline to pass.
+func (b *bot) waitForBackgroundJobs() {
+	log.Warn("Waiting for background goroutines to terminate...")
+
+	done := make(chan struct{})
+	go func() {
+		b.backgroundJobs.Wait()
+		// the background jobs can reply to users too, so this has to wait until they're done
+		for b.repliesPending() {
+			time.Sleep(replyDrainInterval)
 		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Warn("Background goroutines complete, exiting.")
+	case <-b.shutdownDeadline:
+		log.Error("Timed out waiting for background goroutines, exiting anyway.")
 	}
 }
 
-func (b *bot) processJobs() {
-	// Everything runs synchronously in this thread right now. This might need changed eventually.
-	log.Debug("Starting jobs")
-	b.doSearches()
-	b.doUserMonitoring()
-	log.Debug("Done with jobs")
+func (b *bot) poller() {
+	defer logPanic()
+	defer b.backgroundJobs.Done()
+
+	b.scheduler.run(b.shouldQuit)
+	log.Info("stopped poller")
 }
 
-func (b *bot) doSearches() {
-	logger := log.WithField("func", "doSearches")
-	logger.Debug("Running searches")
+func (b *bot) runSearch(search *db.Search, logger *log.Entry) error {
+	query, options := splitSearch(search.Search)
+	s := b.fa.NewSearchWithOptions(query, options)
+	subs, err := s.GetPage(1)
+	if err != nil {
+		return err
+	}
 
-	err := b.db.IterateSearches(func(search *db.Search, ul db.UserLoader) error {
-		sLogger := logger.WithField("search", search)
-		sLogger.Debug("Iterating search")
+	// we'll need this later but we're goto-ing over it.
+	newSubs := make([]*faapi.Submission, 0)
+	var current *db.Search
 
-		s := b.fa.NewSearch(search.Search)
-		subs, err := s.GetPage(1)
-		if err != nil {
-			return err
-		}
+	if len(subs) == 0 {
+		goto allOut
+	}
 
-		// we'll need this later but we're goto-ing over it.
-		newSubs := make([]*faapi.Submission, 0)
+	if search.LastID == 0 {
+		// first time this search has been run, only store the most recent ID and do nothing else
+		goto updateIDOut
+	}
 
-		if len(subs) == 0 {
-			goto allOut
-		}
+	newSubs, err = b.getNewSearchResults(s, subs, search.LastID, logger)
+	if err != nil {
+		return err
+	}
 
-		if search.LastID == 0 {
-			// first time this search has been run, only store the most recent ID and do nothing else
-			goto updateIDOut
-		}
+	if len(newSubs) == 0 {
+		goto allOut
+	}
+
+	// users may have been added to or removed from the search while we were talking to FA
+	current, err = b.db.GetSearch(search.Search)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return db.ErrNoSearch
+	}
+	search.Users = current.Users
 
+	// pre-fetch all of the preview images asynchronously
+	b.cacheThumbnails(newSubs)
+
+	for i := len(newSubs) - 1; i >= 0; i-- {
+		b.alertForSearchResult(newSubs[i], search)
+	}
+
+updateIDOut:
+	search.LastID = subs[0].ID
+allOut:
+	search.LastRun = time.Now()
+	return nil
+}
+
+// doSearch polls a single search, returning when it should next be retried if it is failing.
+func (b *bot) doSearch(query string) time.Time {
+	logger := log.WithFields(log.Fields{
+		"func":  "doSearch",
+		"query": query,
+	})
+	logger.Debug("Running search")
+
+	// No transaction is held open while we talk to FA, so that users can keep changing their searches.
+	search, err := b.db.GetSearch(query)
+	if err != nil {
+		logger.WithError(err).Error("Unable to load search")
+		return time.Time{}
+	}
+	if search == nil {
+		logger.Debug("Search was deleted before it could run")
+		return time.Time{}
+	}
+
+	logger = logger.WithField("search", search)
+	err = b.runSearch(search, logger)
+	if err == db.ErrNoSearch {
+		logger.Debug("Search was deleted while it was running")
+		return time.Time{}
+	}
+	// a failure here doesn't stop anything else from running, it just makes this search back off
+	b.updateFailureState(&search.FailureState, err, logger)
+
+	err = search.Update()
+	if err == db.ErrNoSearch {
+		logger.Debug("Search was deleted while it was running")
+	} else if err != nil {
+		logger.WithError(err).Error("Unable to save search")
+	}
+	return search.NextRetry
+}
+
+// getNewSearchResults returns the results newer than lastID, starting with the already-retrieved first page. If every
+// result on a page is new, subsequent pages are requested until lastID is reached or the configured page limit is hit.
+// Results are returned newest first, the same as FA provides them.
+func (b *bot) getNewSearchResults(s *faapi.Search, firstPage []*faapi.Submission, lastID int64,
+	logger *log.Entry) ([]*faapi.Submission, error) {
+
+	newSubs := make([]*faapi.Submission, 0)
+	// new submissions can push results onto the next page while we're paging, so skip anything we've already got
+	seen := make(map[int64]bool)
+	subs := firstPage
+	for page := 1; ; page++ {
 		for _, sub := range subs {
 			// submissions could be deleted, or just left out from the results randomly
-			if sub.ID <= search.LastID {
-				break
+			if sub.ID <= lastID {
+				return newSubs, nil
+			}
+			if seen[sub.ID] {
+				continue
 			}
+			seen[sub.ID] = true
 			newSubs = append(newSubs, sub)
 		}
 
-		if len(newSubs) == 0 {
-			goto allOut
+		if len(subs) == 0 {
+			// ran out of results without finding lastID, so it must have been deleted
+			return newSubs, nil
 		}
 
-		if len(newSubs) == len(subs) {
-			// be lazy and don't loop on pages yet
-			sLogger.Error("Received an entire page of new results, some results missed!")
+		if page >= b.c.FA.MaxSearchPages {
+			logger.WithField("pages", page).Warn("Reached search page limit, some results missed!")
+			return newSubs, nil
 		}
 
-		// pre-fetch all of the preview images asynchronously
-		b.cacheThumbnails(newSubs)
-
-		for i := len(newSubs) - 1; i >= 0; i-- {
-			b.alertForSearchResult(newSubs[i], search)
+		logger.WithField("page", page+1).Debug("Entire page of results was new, retrieving next page")
+		var err error
+		subs, err = s.GetPage(page + 1)
+		if err != nil {
+			return nil, err
 		}
+	}
+}
 
-	updateIDOut:
-		search.LastID = subs[0].ID
-	allOut:
-		search.LastRun = time.Now()
-		return search.Update()
-	})
+// hasUserSeenID checks whether the item has already been delivered to the user, marking it as delivered if not.
+func (b *bot) hasUserSeenID(ns db.DeliveryNamespace, id int64, userID int) bool {
+	marked, err := b.db.MarkDelivered(ns, db.TelegramID(userID), id)
 	if err != nil {
-		logger.WithError(err).Error("Unable to process searches")
+		log.WithError(err).WithFields(log.Fields{
+			"func":      "hasUserSeenID",
+			"namespace": ns,
+			"id":        id,
+			"userID":    userID,
+		}).Error("Unable to check delivered index")
+		// a duplicate is better than missing something
+		return false
 	}
+	return !marked
 }
 
-func (b *bot) hasUserSeenID(subID int64, userID int) bool {
-	b.userAlertedMutex.Lock()
-	defer b.userAlertedMutex.Unlock()
+// deliveredPruner periodically removes entries from the delivered index that are older than the configured TTL.
+func (b *bot) deliveredPruner() {
+	defer logPanic()
+	defer b.backgroundJobs.Done()
 
-	// TODO evict entries over time
-	userAlerts := b.userAlertedForID[userID]
-	if userAlerts == nil {
-		userAlerts = make(map[int64]bool)
-		b.userAlertedForID[userID] = userAlerts
+	ttl := b.c.DB.DeliveredTTL.convert()
+	if ttl <= 0 {
+		ttl = defaultDeliveredTTL
 	}
-	if userAlerts[subID] {
-		return true
+
+	ticker := time.NewTicker(deliveredPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.shouldQuit:
+			log.Info("stopping delivered pruner")
+			return
+		case <-ticker.C:
+			pruned, err := b.db.PruneDelivered(time.Now().Add(-ttl))
+			if err != nil {
+				log.WithError(err).Error("Unable to prune delivered index")
+			} else {
+				log.WithField("pruned", pruned).Debug("Pruned delivered index")
+			}
+		}
 	}
-	userAlerts[subID] = true
-	return false
 }
 
 func (b *bot) alertForSearchResult(sub *faapi.Submission, search *db.Search) {
@@ -255,68 +421,260 @@ func (b *bot) alertForSearchResult(sub *faapi.Submission, search *db.Search) {
 		}
 	}
 
-	q := escapeHTML(search.Search)
-	title := escapeHTML(sub.Title)
-	// image captions have a 200 character limit, so we need to crop the search to fit. figure out how long everything
-	// else is first
-	lenCheck := fmt.Sprintf(searchResultTemplate, "", title, sub.User, sub.Rating, sub.ID)
-	limit := 200 - len(lenCheck)
-	if limit < 0 {
-		logger.WithField("limit", limit).Error("No space for search query in caption")
-		q = ""
-	} else if len(q) > limit {
-		// this could leave dangling HTML entities... oh well
-		q = q[:limit]
-	}
-
-	msg := fmt.Sprintf(searchResultTemplate, q, title, sub.User, sub.Rating, sub.ID)
+	trigger := db.Trigger{Kind: db.SearchTrigger, Name: search.Search}
+	n := submissionNotification(sub, trigger)
+	item := submissionDigestItem(fmt.Sprintf("Search: <code>%s</code>", escapeHTML(search.Search)), sub)
 	for uid := range search.Users {
-		if b.hasUserSeenID(sub.ID, int(uid)) {
+		d, ok := b.alertDelivery(int(uid), searchSubscription, search.Search, sub)
+		if !ok {
+			continue
+		}
+		if b.hasUserSeenID(db.SubmissionsDelivered, sub.ID, int(uid)) {
+			b.mergeAlert(int(uid), sub.ID, trigger, item.Trigger)
 			continue
 		}
-		b.tryToSendImage(int(uid), fb, msg)
+		b.deliverAlert(int(uid), fb, n, item, d)
+	}
+}
+
+// submissionNotification makes the notification for a submission that was found by the trigger.
+func submissionNotification(sub *faapi.Submission, trigger db.Trigger) db.Notification {
+	// the title is cropped if it would keep the link from fitting in a caption even without any triggers
+	room := maxCaptionLength - len(fmt.Sprintf(submissionTemplate, "", sub.User, ratingLabel(sub.Rating), sub.ID))
+	body := fmt.Sprintf(submissionTemplate, cropHTML(sub.Title, room), sub.User, ratingLabel(sub.Rating), sub.ID)
+	n := db.Notification{
+		Artist:       sub.User,
+		SubmissionID: sub.ID,
+		Triggers:     []db.Trigger{trigger},
+		Body:         body,
+	}
+	n.Text = submissionCaption(n.Triggers, n.Body)
+	return n
+}
+
+// submissionCaption lists the triggers before the body of a submission alert. Image captions have a length limit, so
+// triggers that don't fit are just counted, and if even one doesn't fit, it is cropped. If there isn't room for any of
+// it, the triggers are left out so the body and its link are never cut off.
+func submissionCaption(triggers []db.Trigger, body string) string {
+	limit := maxCaptionLength - len(": ") - len(body)
+	shown := len(triggers)
+	caption := joinTriggers(triggers, shown, -1)
+	for shown > 1 && len(caption) > limit {
+		shown--
+		caption = joinTriggers(triggers, shown, -1)
+	}
+	if len(caption) > limit {
+		over := len(caption) - limit
+		crop := len(escapeHTML("%s", triggers[0].Name)) - over
+		if crop < minTriggerCrop {
+			return body
+		}
+		caption = joinTriggers(triggers, shown, crop)
 	}
+	return caption + ": " + body
 }
 
-func (b *bot) doUserMonitoring() {
-	logger := log.WithField("func", "doUserMonitoring")
-	logger.Debug("Monitoring users")
+// joinTriggers describes the first shown triggers in HTML, and how many more there are. If crop isn't negative, the
+// first trigger's escaped name is cropped to at most that length.
+func joinTriggers(triggers []db.Trigger, shown, crop int) string {
+	parts := make([]string, shown)
+	for i, t := range triggers[:shown] {
+		name := escapeHTML("%s", t.Name)
+		if i == 0 && crop >= 0 {
+			name = cropHTML(t.Name, crop)
+		}
+		switch t.Kind {
+		case db.SearchTrigger:
+			parts[i] = "<b>Search:</b> <code>" + name + "</code>"
+		default:
+			parts[i] = "<b>Artist:</b> " + name
+		}
+	}
+	s := strings.Join(parts, ", ")
+	if shown < len(triggers) {
+		s += fmt.Sprintf(" and %d more", len(triggers)-shown)
+	}
+	return s
+}
 
-	err := b.db.IterateUsers(func(faUser *db.FAUser, ul db.UserLoader) error {
-		uLogger := logger.WithField("faUser", faUser)
-		uLogger.Debug("Iterating user")
+// cropHTML escapes s, cropping it with an ellipsis if needed so the escaped text is at most max bytes.
+func cropHTML(s string, max int) string {
+	return cropMarkup(escapeHTML("%s", s), max)
+}
 
-		u := b.fa.NewUser(faUser.Username)
-		subs, journs, err := u.GetRecent()
-		if err != nil {
-			return err
+// cropMarkup crops HTML with an ellipsis if needed so that it is at most max bytes. It is only cut between characters
+// of the text, never inside a tag or an entity, and any tags left open are closed after the ellipsis.
+func cropMarkup(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	cropped := ""
+	var open []string
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '<':
+			end := strings.IndexByte(s[i:], '>')
+			if end < 0 {
+				return cropped
+			}
+			tag := s[i+1 : i+end]
+			i += end + 1
+			if strings.HasPrefix(tag, "/") {
+				if len(open) > 0 {
+					open = open[:len(open)-1]
+				}
+			} else if name := strings.Fields(tag); len(name) > 0 {
+				open = append(open, name[0])
+			}
+			// cutting right after a tag doesn't leave any more text than cutting right before it
+			continue
+		case '&':
+			if end := strings.IndexByte(s[i:], ';'); end >= 0 {
+				i += end + 1
+			} else {
+				i++
+			}
+		default:
+			_, size := utf8.DecodeRuneInString(s[i:])
+			i += size
 		}
 
-		err = b.handleUserSubmissions(faUser, ul, subs)
-		if err != nil {
-			return err
+		c := s[:i] + "…"
+		for j := len(open) - 1; j >= 0; j-- {
+			c += "</" + open[j] + ">"
 		}
+		// it only gets longer from here
+		if len(c) > max {
+			break
+		}
+		cropped = c
+	}
+	return cropped
+}
 
-		err = b.handleUserJournals(faUser, ul, journs)
-		if err != nil {
-			return err
+// mergeAlert adds the trigger to the user's alert for the submission, if it hasn't been sent yet. digestTrigger is how
+// the trigger is described in digests.
+func (b *bot) mergeAlert(userID int, submissionID int64, trigger db.Trigger, digestTrigger string) {
+	logger := log.WithFields(log.Fields{
+		"func":         "mergeAlert",
+		"userID":       userID,
+		"submissionID": submissionID,
+		"trigger":      trigger,
+	})
+
+	merged, err := b.db.MergeNotification(db.TelegramID(userID), submissionID, func(n *db.Notification) {
+		for _, t := range n.Triggers {
+			if t == trigger {
+				return
+			}
 		}
+		n.Triggers = append(n.Triggers, trigger)
+		n.Text = submissionCaption(n.Triggers, n.Body)
+	})
+	if err != nil {
+		logger.WithError(err).Error("Unable to add trigger to alert")
+		return
+	}
+	if merged {
+		return
+	}
 
-		faUser.LastRun = time.Now()
-		return faUser.Update()
+	_, err = b.db.MergeDigestItem(db.TelegramID(userID), submissionID, func(item *db.DigestItem) {
+		if !strings.Contains(item.Trigger, digestTrigger) {
+			item.Trigger += ", " + digestTrigger
+		}
 	})
+	if err != nil {
+		logger.WithError(err).Error("Unable to add trigger to digest item")
+	}
+	// otherwise, it was already sent
+}
 
+func (b *bot) monitorUser(faUser *db.FAUser) error {
+	u := b.fa.NewUser(faUser.Username)
+	subs, journs, err := u.GetRecent()
 	if err != nil {
-		logger.WithError(err).Error("Unable to process users")
+		return err
+	}
+
+	// keep up with the user changing how their name is written
+	if len(subs) > 0 && subs[0].User != "" {
+		faUser.DisplayName = subs[0].User
 	}
+
+	err = b.handleUserSubmissions(faUser, subs)
+	if err != nil {
+		return err
+	}
+
+	err = b.handleUserJournals(faUser, journs)
+	if err != nil {
+		return err
+	}
+
+	faUser.LastRun = time.Now()
+	return nil
 }
 
-func (b *bot) handleUserSubmissions(faUser *db.FAUser, ul db.UserLoader, subs []*faapi.Submission) error {
+// refreshUserSubscribers reloads who wants alerts for faUser, since they may have changed while we were talking to FA.
+func (b *bot) refreshUserSubscribers(faUser *db.FAUser) error {
+	current, err := b.db.GetFAUser(faUser.Username)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return db.ErrNoFAUser
+	}
+	faUser.SubmissionUsers = current.SubmissionUsers
+	faUser.JournalUsers = current.JournalUsers
+	return nil
+}
+
+// doUserMonitoring checks a single furaffinity user, returning when they should next be retried if it is failing.
+func (b *bot) doUserMonitoring(username string) time.Time {
+	logger := log.WithFields(log.Fields{
+		"func":     "doUserMonitoring",
+		"username": username,
+	})
+	logger.Debug("Monitoring user")
+
+	// No transaction is held open while we talk to FA, so that users can keep changing their alerts.
+	faUser, err := b.db.GetFAUser(username)
+	if err != nil {
+		logger.WithError(err).Error("Unable to load user")
+		return time.Time{}
+	}
+	if faUser == nil {
+		logger.Debug("User was deleted before they could be monitored")
+		return time.Time{}
+	}
+
+	logger = logger.WithField("faUser", faUser)
+	err = b.monitorUser(faUser)
+	if err == db.ErrNoFAUser {
+		logger.Debug("User was deleted while they were being monitored")
+		return time.Time{}
+	}
+	// a failure here doesn't stop anything else from running, it just makes this user back off
+	b.updateFailureState(&faUser.FailureState, err, logger)
+
+	err = faUser.Update()
+	if err == db.ErrNoFAUser {
+		logger.Debug("User was deleted while they were being monitored")
+	} else if err != nil {
+		logger.WithError(err).Error("Unable to save user")
+	}
+	return faUser.NextRetry
+}
+
+func (b *bot) handleUserSubmissions(faUser *db.FAUser, subs []*faapi.Submission) error {
 	logger := log.WithFields(log.Fields{
 		"func":   "handleUserSubmissions",
 		"faUser": faUser,
 	})
 	newSubs := make([]*faapi.Submission, 0)
+	var err error
 	if len(subs) == 0 {
 		return nil
 	}
@@ -339,8 +697,16 @@ func (b *bot) handleUserSubmissions(faUser *db.FAUser, ul db.UserLoader, subs []
 	}
 
 	if len(newSubs) == len(subs) {
-		// TODO we don't have a way to get multiple pages yet
-		logger.Error("Received more submissions than recents can show, some missed!")
+		logger.Debug("Received more submissions than recents can show, checking gallery")
+		newSubs, err = b.getNewGallerySubmissions(faUser, newSubs, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = b.refreshUserSubscribers(faUser)
+	if err != nil {
+		return err
 	}
 
 	// pre-fetch all of the preview images asynchronously
@@ -355,6 +721,60 @@ updateIDOut:
 	return nil
 }
 
+// getNewGallerySubmissions walks the user's gallery pages until it finds the last submission we saw or hits the
+// configured page limit. Anything from recents is kept, since the gallery may not include submissions in scraps.
+// Results are returned newest first.
+func (b *bot) getNewGallerySubmissions(faUser *db.FAUser, recent []*faapi.Submission,
+	logger *log.Entry) ([]*faapi.Submission, error) {
+
+	u := b.fa.NewUser(faUser.Username)
+	// the first gallery page overlaps recents, and new submissions can push results onto the next page while we're
+	// paging, so skip anything we've already got
+	seen := make(map[int64]bool)
+	for _, sub := range recent {
+		seen[sub.ID] = true
+	}
+	newSubs := append(make([]*faapi.Submission, 0, len(recent)), recent...)
+
+	for page := uint(1); ; page++ {
+		if page > uint(b.c.FA.MaxGalleryPages) {
+			logger.WithField("pages", page-1).Warn("Reached gallery page limit, some submissions missed!")
+			break
+		}
+
+		subs, err := u.GetSubmissions(page)
+		if err != nil {
+			return nil, err
+		}
+		if len(subs) == 0 {
+			// ran out of gallery without finding the last submission, so it must have been deleted
+			break
+		}
+
+		found := false
+		for _, sub := range subs {
+			if sub.ID <= faUser.LastSubmissionID {
+				found = true
+				break
+			}
+			if seen[sub.ID] {
+				continue
+			}
+			seen[sub.ID] = true
+			newSubs = append(newSubs, sub)
+		}
+		if found {
+			break
+		}
+	}
+
+	// recents include scraps which the gallery does not, so put everything back in order
+	sort.Slice(newSubs, func(i, j int) bool {
+		return newSubs[i].ID > newSubs[j].ID
+	})
+	return newSubs, nil
+}
+
 func (b *bot) alertForUserSubmission(sub *faapi.Submission, faUser *db.FAUser) {
 	logger := log.WithFields(log.Fields{
 		"func":   "alertForUserSubmission",
@@ -373,16 +793,23 @@ func (b *bot) alertForUserSubmission(sub *faapi.Submission, faUser *db.FAUser) {
 		}
 	}
 
-	msg := fmt.Sprintf(submissionTemplate, escapeHTML(sub.Title), sub.User, sub.Rating, sub.ID)
+	trigger := db.Trigger{Kind: db.ArtistTrigger, Name: faUser.Name()}
+	n := submissionNotification(sub, trigger)
+	item := submissionDigestItem("Submissions from "+escapeHTML(faUser.Name()), sub)
 	for uid := range faUser.SubmissionUsers {
-		if b.hasUserSeenID(sub.ID, int(uid)) {
+		d, ok := b.alertDelivery(int(uid), submissionsSubscription, faUser.Username, sub)
+		if !ok {
 			continue
 		}
-		b.tryToSendImage(int(uid), fb, msg)
+		if b.hasUserSeenID(db.SubmissionsDelivered, sub.ID, int(uid)) {
+			b.mergeAlert(int(uid), sub.ID, trigger, item.Trigger)
+			continue
+		}
+		b.deliverAlert(int(uid), fb, n, item, d)
 	}
 }
 
-func (b *bot) handleUserJournals(faUser *db.FAUser, ul db.UserLoader, journs []*faapi.Journal) error {
+func (b *bot) handleUserJournals(faUser *db.FAUser, journs []*faapi.Journal) error {
 	logger := log.WithFields(log.Fields{
 		"func":   "handleUserJournals",
 		"faUser": faUser,
@@ -414,6 +841,10 @@ func (b *bot) handleUserJournals(faUser *db.FAUser, ul db.UserLoader, journs []*
 		logger.Error("Received more journals than recents can show, some missed!")
 	}
 
+	if err := b.refreshUserSubscribers(faUser); err != nil {
+		return err
+	}
+
 	for i := len(newJourns) - 1; i >= 0; i-- {
 		b.alertForUserJournal(newJourns[i], faUser)
 	}
@@ -424,12 +855,23 @@ updateIDOut:
 }
 
 func (b *bot) alertForUserJournal(journ *faapi.Journal, faUser *db.FAUser) {
-	msg := fmt.Sprintf(journalTemplate, escapeHTML(journ.Title), journ.User, journ.ID)
+	// journals only know the name we asked FA for, which is all lower case
+	n := db.Notification{
+		Text:   fmt.Sprintf(journalTemplate, escapeHTML(journ.Title), faUser.Name(), journ.ID),
+		Artist: faUser.Name(),
+	}
+	item := db.DigestItem{
+		Trigger: "Journals from " + escapeHTML(faUser.Name()),
+		Title:   journ.Title,
+		User:    faUser.Name(),
+		Link:    fmt.Sprintf("https://www.furaffinity.net/journal/%d/", journ.ID),
+	}
 	for uid := range faUser.JournalUsers {
-		if b.hasUserSeenID(journ.ID, int(uid)) {
+		d, ok := b.alertDelivery(int(uid), journalsSubscription, faUser.Username, nil)
+		if !ok || b.hasUserSeenID(db.JournalsDelivered, journ.ID, int(uid)) {
 			continue
 		}
-		b.sendHTMLMessage(int(uid), msg)
+		b.deliverAlert(int(uid), nil, n, item, d)
 	}
 }
 
@@ -437,12 +879,12 @@ func (b *bot) cacheThumbnails(subs []*faapi.Submission) {
 	wg := sync.WaitGroup{}
 	wg.Add(len(subs))
 	for _, sub := range subs {
-		go func() {
+		go func(sub *faapi.Submission) {
 			// Submission caches the image, so we just need to invoke this to make it download.
 			// If there's an error, it won't cache that and will try again later and return the error if it recurs.
 			_, _ = sub.PreviewImage()
 			wg.Done()
-		}()
+		}(sub)
 	}
 	wg.Wait()
 }
@@ -0,0 +1,187 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/ajanata/fanotify/db"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestCropMarkup(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		max  int
+		want string
+	}{
+		{"short enough", "<b>cat</b>", 10, "<b>cat</b>"},
+		{"plain text", "abcdefgh", 6, "abc…"},
+		{"not enough room", "abcdefgh", 3, ""},
+		{"multibyte characters kept whole", "ääää", 6, "ä…"},
+		{"entities kept whole", "a&amp;b&lt;c", 8, "a…"},
+		{"entity fits", "a&amp;b&lt;c", 12, "a&amp;b&lt;c"},
+		{"entity then more", "a&amp;bcdefghij", 11, "a&amp;bc…"},
+		{"open tag closed", "<b>abcdefgh</b>", 13, "<b>abc…</b>"},
+		{"nested tags closed", "<b><i>abcdefgh</i></b>", 20, "<b><i>abc…</i></b>"},
+		{"closed tag not reopened", "<b>ab</b>cdefgh", 14, "<b>ab</b>cd…"},
+		{"tag attributes kept whole", `<a href="https://example.com/">link text</a>`, 40,
+			`<a href="https://example.com/">li…</a>`},
+		{"tag that can't fit", `<a href="https://example.com/">link text</a>`, 20, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := cropMarkup(test.s, test.max)
+			if got != test.want {
+				t.Errorf("cropMarkup(%q, %d) = %q, want %q", test.s, test.max, got, test.want)
+			}
+			if len(got) > test.max {
+				t.Errorf("cropMarkup(%q, %d) is %d bytes", test.s, test.max, len(got))
+			}
+		})
+	}
+}
+
+func TestNotificationMessageCropsCaption(t *testing.T) {
+	n := &db.Notification{
+		UserID: 1,
+		Text:   "<b>Search:</b> <code>" + strings.Repeat("é&amp;", 50) + "</code>",
+		Photo:  []byte{1},
+	}
+	m, ok := notificationMessage(n).(tgbotapi.PhotoConfig)
+	if !ok {
+		t.Fatalf("notificationMessage didn't make a photo upload")
+	}
+	if len(m.Caption) > maxCaptionLength {
+		t.Errorf("caption is %d bytes", len(m.Caption))
+	}
+	if !strings.HasSuffix(m.Caption, "…</code>") {
+		t.Errorf("caption %q wasn't cropped inside its tag", m.Caption)
+	}
+	if !utf8.ValidString(m.Caption) || strings.Count(m.Caption, "&") != strings.Count(m.Caption, ";") {
+		t.Errorf("caption %q was cut inside a character or entity", m.Caption)
+	}
+}
+
+func TestCropHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		max  int
+		want string
+	}{
+		{"short enough", "cat", 3, "cat"},
+		{"escaped", "a<b", 6, "a&lt;b"},
+		{"cropped", "abcdefgh", 6, "abc…"},
+		{"cropped after escaping", "a<bcdef", 8, "a&lt;…"},
+		{"entity not split", "a<bcdef", 7, "a…"},
+		{"multibyte characters kept whole", "ääää", 6, "ä…"},
+		{"no room", "abcdef", 2, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := cropHTML(test.s, test.max); got != test.want {
+				t.Errorf("cropHTML(%q, %d) = %q, want %q", test.s, test.max, got, test.want)
+			}
+		})
+	}
+}
+
+func TestJoinTriggers(t *testing.T) {
+	search := db.Trigger{Kind: db.SearchTrigger, Name: "cat"}
+	artist := db.Trigger{Kind: db.ArtistTrigger, Name: "Fox"}
+	tests := []struct {
+		name     string
+		triggers []db.Trigger
+		shown    int
+		crop     int
+		want     string
+	}{
+		{"search", []db.Trigger{search}, 1, -1, "<b>Search:</b> <code>cat</code>"},
+		{"artist", []db.Trigger{artist}, 1, -1, "<b>Artist:</b> Fox"},
+		{"several", []db.Trigger{search, artist}, 2, -1, "<b>Search:</b> <code>cat</code>, <b>Artist:</b> Fox"},
+		{"some counted", []db.Trigger{search, artist, artist}, 1, -1, "<b>Search:</b> <code>cat</code> and 2 more"},
+		{"escaped", []db.Trigger{{Kind: db.SearchTrigger, Name: "cat & <dog>"}}, 1, -1,
+			"<b>Search:</b> <code>cat &amp; &lt;dog&gt;</code>"},
+		{"first cropped", []db.Trigger{{Kind: db.SearchTrigger, Name: "abcdefghij"}, artist}, 2, 7,
+			"<b>Search:</b> <code>abcd…</code>, <b>Artist:</b> Fox"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := joinTriggers(test.triggers, test.shown, test.crop); got != test.want {
+				t.Errorf("joinTriggers(%v, %d, %d) = %q, want %q", test.triggers, test.shown, test.crop, got,
+					test.want)
+			}
+		})
+	}
+}
+
+func TestSubmissionCaption(t *testing.T) {
+	search := func(name string) db.Trigger {
+		return db.Trigger{Kind: db.SearchTrigger, Name: name}
+	}
+	artist := db.Trigger{Kind: db.ArtistTrigger, Name: "Fox"}
+	// bodies that leave this much room for the triggers
+	body := func(room int) string {
+		return strings.Repeat("x", maxCaptionLength-len(": ")-room)
+	}
+	tests := []struct {
+		name     string
+		triggers []db.Trigger
+		body     string
+		want     string
+	}{
+		{"one trigger", []db.Trigger{search("cat")}, body(50), "<b>Search:</b> <code>cat</code>: " + body(50)},
+		{"merged triggers", []db.Trigger{search("cat"), artist}, body(60),
+			"<b>Search:</b> <code>cat</code>, <b>Artist:</b> Fox: " + body(60)},
+		{"triggers that don't fit are counted", []db.Trigger{search("cat"), artist, search("dog")}, body(50),
+			"<b>Search:</b> <code>cat</code> and 2 more: " + body(50)},
+		{"long trigger cropped", []db.Trigger{search("abcdefghijklmnopqrstuvwxyz")}, body(50),
+			"<b>Search:</b> <code>abcdefghijklmnopqrs…</code>: " + body(50)},
+		{"multibyte trigger cropped", []db.Trigger{search("ääääääääääääää")}, body(50),
+			"<b>Search:</b> <code>äääääääää…</code>: " + body(50)},
+		{"escaped trigger cropped", []db.Trigger{search("cats & dogs & birds & fish")}, body(50),
+			"<b>Search:</b> <code>cats &amp; dogs …</code>: " + body(50)},
+		{"no room for triggers", []db.Trigger{search("cat"), artist}, body(8), body(8)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := submissionCaption(test.triggers, test.body)
+			if got != test.want {
+				t.Errorf("submissionCaption(%v) = %q, want %q", test.triggers, got, test.want)
+			}
+			if len(got) > maxCaptionLength {
+				t.Errorf("submissionCaption(%v) is %d bytes", test.triggers, len(got))
+			}
+		})
+	}
+}
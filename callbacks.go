@@ -0,0 +1,338 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/ajanata/fanotify/db"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// subscriptionKind is the kind of subscription an inline keyboard button refers to.
+	subscriptionKind string
+)
+
+const (
+	searchSubscription      subscriptionKind = "s"
+	submissionsSubscription subscriptionKind = "u"
+	journalsSubscription    subscriptionKind = "j"
+
+	callbackAdd    = "a"
+	callbackDelete = "d"
+	callbackPause  = "p"
+	callbackBlock  = "b"
+
+	// callbackTokenLength is how many bytes of the HMAC are used to identify a subscription. Callback data is limited
+	// to 64 bytes, which is too short for most searches, so we send this instead and find the matching subscription
+	// when the button is pressed.
+	callbackTokenLength = 9
+
+	// Telegram doesn't show much of a button's text anyway.
+	maxButtonTextLength = 40
+)
+
+// callbackToken identifies one of a user's subscriptions in callback data. It is signed with the bot's token, so it
+// can't be forged, and it includes the user's ID, so it only matches that user's subscriptions.
+func (b *bot) callbackToken(userID int, kind subscriptionKind, key string) string {
+	mac := hmac.New(sha256.New, []byte(b.c.TG.Token))
+	_, _ = fmt.Fprintf(mac, "%d\x00%s\x00%s", userID, kind, key)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:callbackTokenLength])
+}
+
+func (b *bot) callbackData(action string, userID int, kind subscriptionKind, key string) string {
+	return strings.Join([]string{action, string(kind), b.callbackToken(userID, kind, key)}, ":")
+}
+
+// subscriptionKeyboard makes an inline keyboard with buttons to manage each of the given subscriptions.
+func (b *bot) subscriptionKeyboard(user *db.TGUser, kind subscriptionKind,
+	keys []string) tgbotapi.InlineKeyboardMarkup {
+
+	userID := int(user.ID)
+	rows := make([][]tgbotapi.InlineKeyboardButton, len(keys))
+	for i, key := range keys {
+		label := key
+		if kind != searchSubscription {
+			label = b.faUserName(key)
+		}
+		pause := "Pause "
+		if isPaused(user, kind, key) {
+			pause = "Resume "
+		}
+		row := tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(buttonText(pause+label),
+				b.callbackData(callbackPause, userID, kind, key)),
+		)
+		if kind != journalsSubscription {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData("Ratings",
+				b.callbackData(callbackRatings, userID, kind, key)))
+		}
+		rows[i] = append(row,
+			tgbotapi.NewInlineKeyboardButtonData("Delete", b.callbackData(callbackDelete, userID, kind, key)))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func buttonText(s string) string {
+	// cut on runes, since Telegram rejects invalid UTF-8
+	r := []rune(s)
+	if len(r) > maxButtonTextLength {
+		return string(r[:maxButtonTextLength-3]) + "..."
+	}
+	return s
+}
+
+// sendSubscriptionList sends a list of the user's subscriptions of the given kind, with buttons to manage each of them.
+func (b *bot) sendSubscriptionList(u *tgbotapi.User, kind subscriptionKind) {
+	if !b.userStartedBot(u.ID) {
+		return
+	}
+
+	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
+	if err != nil || user == nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":     "sendSubscriptionList",
+			"userID":   u.ID,
+			"username": u.UserName,
+		}).Error("Could not load user")
+		b.sendMessage(u.ID, loadFailedFormat, "your saved alerts")
+		return
+	}
+
+	msg, keys := b.subscriptionList(user, kind)
+	if len(keys) == 0 {
+		b.sendMessage(u.ID, msg)
+		return
+	}
+
+	m := tgbotapi.NewMessage(int64(u.ID), msg)
+	m.ParseMode = "HTML"
+	m.ReplyMarkup = b.subscriptionKeyboard(user, kind, keys)
+	b.send(u.ID, m)
+}
+
+// subscriptions returns the keys of the user's subscriptions of the given kind.
+func subscriptions(user *db.TGUser, kind subscriptionKind) map[string]bool {
+	switch kind {
+	case searchSubscription:
+		return user.Searches
+	case submissionsSubscription:
+		return user.SubmissionUsers
+	case journalsSubscription:
+		return user.JournalUsers
+	default:
+		return nil
+	}
+}
+
+// subscriptionList formats the user's subscriptions of the given kind, returning them in the order they are listed.
+// If there aren't any, the message says so.
+func (b *bot) subscriptionList(user *db.TGUser, kind subscriptionKind) (string, []string) {
+	switch kind {
+	case searchSubscription:
+		if len(user.Searches) == 0 {
+			return noSearchesMsg, nil
+		}
+		msg, keys := searchList(user)
+		return msg + listSearchSuffix, keys
+	case submissionsSubscription:
+		msg, keys := b.monitoredUserList(user, false)
+		if len(keys) == 0 {
+			return msg, nil
+		}
+		return msg + listSubmissionsSuffix, keys
+	case journalsSubscription:
+		msg, keys := b.monitoredUserList(user, true)
+		if len(keys) == 0 {
+			return msg, nil
+		}
+		return msg + listJournalsSuffix, keys
+	default:
+		return "", nil
+	}
+}
+
+func (b *bot) dispatchCallback(q *tgbotapi.CallbackQuery) {
+	logger := log.WithFields(log.Fields{
+		"func": "dispatchCallback",
+		"from": q.From.UserName,
+		"data": q.Data,
+	})
+	logger.Debug("Received callback query")
+
+	parts := strings.SplitN(q.Data, ":", 3)
+	if len(parts) != 3 || !b.userStartedBot(q.From.ID) {
+		b.answerCallback(q, "Sorry, I don't know what to do with that button.")
+		return
+	}
+	action, kind, token := parts[0], subscriptionKind(parts[1]), parts[2]
+	if action == callbackBlock {
+		// artists aren't subscriptions, and anyone can block anyone, so the name is sent as is
+		b.callbackBlock(q, token)
+		return
+	}
+
+	user, err := b.db.GetTGUser(db.TelegramID(q.From.ID))
+	if err != nil || user == nil {
+		logger.WithError(err).Error("Could not load user")
+		b.answerCallback(q, fmt.Sprintf(loadFailedFormat, "your saved alerts"))
+		return
+	}
+
+	candidates := subscriptions(user, kind)
+	if action == callbackAdd {
+		// these aren't saved yet, that's the point
+		candidates = b.pendingTestSearch(q.From.ID)
+	}
+
+	var key string
+	found := false
+	for k := range candidates {
+		if hmac.Equal([]byte(b.callbackToken(q.From.ID, kind, k)), []byte(token)) {
+			key = k
+			found = true
+			break
+		}
+	}
+	if !found && action == callbackAdd {
+		b.answerCallback(q, "That test search has expired. Please send /addsearch to add it.")
+		return
+	}
+	if !found {
+		b.answerCallback(q, "You don't have that saved anymore.")
+		b.refreshSubscriptionList(q, kind)
+		return
+	}
+
+	switch action {
+	case callbackAdd:
+		b.callbackAdd(q, kind, key)
+	case callbackDelete:
+		b.callbackDelete(q, kind, key)
+	case callbackPause:
+		b.callbackPause(q, kind, key)
+	case callbackRatings:
+		b.callbackRatings(q, user, kind, key)
+	default:
+		if rating, ok := toggledRating(action); ok {
+			b.callbackToggleRating(q, kind, key, rating)
+			return
+		}
+		b.answerCallback(q, "Sorry, I don't know what to do with that button.")
+	}
+}
+
+func (b *bot) callbackAdd(q *tgbotapi.CallbackQuery, kind subscriptionKind, key string) {
+	if kind != searchSubscription {
+		b.answerCallback(q, "Sorry, I don't know what to do with that button.")
+		return
+	}
+
+	b.answerCallback(q, "Adding search.")
+	b.addSearch(q.From, key)
+}
+
+func (b *bot) callbackDelete(q *tgbotapi.CallbackQuery, kind subscriptionKind, key string) {
+	logger := log.WithFields(log.Fields{
+		"func":     "callbackDelete",
+		"userID":   q.From.ID,
+		"username": q.From.UserName,
+		"kind":     kind,
+		"key":      key,
+	})
+
+	label := key
+	if kind != searchSubscription {
+		label = b.faUserName(key)
+	}
+
+	userID := db.TelegramID(q.From.ID)
+	var err error
+	switch kind {
+	case searchSubscription:
+		err = b.db.DeleteSearchForUser(userID, key)
+	case submissionsSubscription:
+		err = b.db.DeleteUserSubmissionsForUser(userID, key)
+	case journalsSubscription:
+		err = b.db.DeleteUserJournalsForUser(userID, key)
+	}
+
+	switch err {
+	case nil, db.ErrNoSearch, db.ErrNoFAUser:
+		// if it was already gone, that's what they wanted anyway
+		b.answerCallback(q, "Deleted "+label+".")
+	default:
+		logger.WithError(err).Error("Unable to delete subscription for user")
+		b.answerCallback(q, fmt.Sprintf(saveFailedFormat, "deletion"))
+	}
+	b.refreshSubscriptionList(q, kind)
+}
+
+// refreshSubscriptionList updates the list the button was pressed on to match what the user currently has saved.
+func (b *bot) refreshSubscriptionList(q *tgbotapi.CallbackQuery, kind subscriptionKind) {
+	if q.Message == nil {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"func":   "refreshSubscriptionList",
+		"userID": q.From.ID,
+	})
+
+	user, err := b.db.GetTGUser(db.TelegramID(q.From.ID))
+	if err != nil || user == nil {
+		logger.WithError(err).Error("Could not load user")
+		return
+	}
+
+	msg, keys := b.subscriptionList(user, kind)
+	if msg == "" {
+		return
+	}
+	m := tgbotapi.NewEditMessageText(q.Message.Chat.ID, q.Message.MessageID, msg)
+	m.ParseMode = "HTML"
+	if len(keys) > 0 {
+		keyboard := b.subscriptionKeyboard(user, kind, keys)
+		m.ReplyMarkup = &keyboard
+	}
+	b.send(q.From.ID, m)
+}
+
+// answerCallback tells Telegram we handled the button press, showing the text to the user.
+func (b *bot) answerCallback(q *tgbotapi.CallbackQuery, text string) {
+	_, err := b.tg.AnswerCallbackQuery(tgbotapi.NewCallback(q.ID, text))
+	if err != nil {
+		log.WithError(err).WithField("func", "answerCallback").Error("Unable to answer callback query")
+	}
+}
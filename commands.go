@@ -29,6 +29,9 @@
 package main
 
 import (
+	"sort"
+	"strings"
+
 	"github.com/ajanata/fanotify/db"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	log "github.com/sirupsen/logrus"
@@ -43,13 +46,16 @@ const (
 Please consult the /help for a list of commands.`
 
 	helpMsg = `FurAffinity Notifier bot will perform searches or monitor user submissions and journals and alert you when there are new items.
-In most circumstances, you should only be notified once about a particular submission. If the bot is restarted, you <i>may</i> get a duplicate notification, if it matches more than one trigger.
+You will only be notified once about a particular submission, even if it matches more than one trigger. The notification lists every trigger that found it.
 
 This bot is still in development. Not all features are complete, and it may not have great uptime.
 
 /addsearch: Add a search.
 /delsearch: Delete a search.
+/editsearch: Change a saved search, without missing anything it would have found.
+/filtersearch: Skip results of a saved search by words or regular expressions.
 /listsearch: List saved searches.
+/testsearch: Show what a search finds right now, without saving it.
 
 /addsubmissions: Add a user submissions notification.
 /delsubmissions: Delete a user submissions notification.
@@ -57,7 +63,25 @@ This bot is still in development. Not all features are complete, and it may not
 
 /addjournals: Add a user journals notification.
 /deljournals: Delete a user journals notification.
-/listjournals: List saved user journals notifications.`
+/listjournals: List saved user journals notifications.
+
+The list commands have buttons to pause or delete each notification, and to choose which ratings of submission it sends. Paused notifications skip anything new until you resume them.
+
+/snooze: Silence all notifications for a while, like <code>/snooze 8h</code>. Add <code>hold</code> to get them when the snooze ends instead.
+/digest: Get notifications together in an hourly or daily digest instead of as they are found.
+/quiethours: Hold notifications during part of each day, like <code>/quiethours 23:00-07:00 Europe/Berlin</code>, and get them when it ends.
+
+/status: Show whether each of your notifications is working.
+
+/block: Never get notifications about an artist, however they were found. Notifications have a button for this too.
+/unblock: Get notifications about a blocked artist again.
+
+/export: Get a file with all of your notifications and their settings.
+/import: Add the notifications from a file from /export, here or on another bot.
+
+The add and delete commands can be given what to add or delete directly, like <code>/addsearch cute fox</code> or <code>/delsubmissions artistname</code>. Otherwise, I will ask for it.
+
+Searches can be narrowed down to types and ratings of submission by writing them after it with a #, like <code>/addsearch cute fox #art #general</code>. The types are art, flash, photo, music, story and poetry, and the ratings are general, mature and adult.`
 )
 
 func (b *bot) dispatchCommand(cmd *tgbotapi.Message) {
@@ -68,35 +92,58 @@ func (b *bot) dispatchCommand(cmd *tgbotapi.Message) {
 	})
 	logger.Debug("Received command")
 
+	args := strings.TrimSpace(cmd.CommandArguments())
 	switch cmd.Command() {
 	case "addjournals":
-		b.cmdAddJournals(cmd.From)
+		b.cmdAddJournals(cmd.From, args)
 	case "addsearch":
-		b.cmdAddSearch(cmd.From)
+		b.cmdAddSearch(cmd.From, args)
 	case "addsubmissions":
-		b.cmdAddSubmissions(cmd.From)
+		b.cmdAddSubmissions(cmd.From, args)
+	case "block":
+		b.cmdBlock(cmd.From, args)
 	case "cancel":
 		b.cmdCancel(cmd.From)
 	case "deljournals":
-		b.cmdAddJournals(cmd.From)
+		b.cmdDelJournals(cmd.From, args)
 	case "delsearch":
-		b.cmdDelSearch(cmd.From)
+		b.cmdDelSearch(cmd.From, args)
 	case "delsubmissions":
-		b.cmdDelSubmissions(cmd.From)
+		b.cmdDelSubmissions(cmd.From, args)
+	case "digest":
+		b.cmdDigest(cmd.From, args)
+	case "editsearch":
+		b.cmdEditSearch(cmd.From, args)
+	case "export":
+		b.cmdExport(cmd.From)
+	case "filtersearch":
+		b.cmdFilterSearch(cmd.From, args)
 	case "help":
 		b.cmdHelp(cmd.From)
+	case "import":
+		b.cmdImport(cmd.From, args)
 	case "listjournals":
 		b.cmdListJournals(cmd.From)
 	case "listsearch":
 		b.cmdListSearch(cmd.From)
 	case "listsubmissions":
 		b.cmdListSubmissions(cmd.From)
+	case "snooze":
+		b.cmdSnooze(cmd.From, args)
+	case "quiethours":
+		b.cmdQuietHours(cmd.From, args)
 	case "shutdown":
 		b.cmdShutdown(cmd.From)
 	case "start":
 		b.cmdStart(cmd.From)
+	case "status":
+		b.cmdStatus(cmd.From)
 	case "stop":
 		b.cmdStop(cmd.From)
+	case "testsearch":
+		b.cmdTestSearch(cmd.From, args)
+	case "unblock":
+		b.cmdUnblock(cmd.From, args)
 	}
 }
 
@@ -119,10 +166,8 @@ func (b *bot) cmdShutdown(u *tgbotapi.User) {
 		return
 	}
 
-	log.Warn("Shutting bot down.\nWaiting for background goroutines to terminate...")
-	close(b.shouldQuit)
-	b.backgroundJobs.Wait()
-	log.Warn("Background goroutines complete, exiting.")
+	// this only tells everything to stop, the update loop does the waiting once it notices
+	b.stop()
 }
 
 func (b *bot) cmdStart(u *tgbotapi.User) {
@@ -191,3 +236,13 @@ func (b *bot) cmdStop(u *tgbotapi.User) {
 
 	logger.Info("User stopped the bot")
 }
+
+// sortedKeys returns the keys of m in sorted order, so that lists always come out the same way.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
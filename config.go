@@ -42,30 +42,57 @@ type (
 		LogLevel       string `default:"INFO"`
 		LogForceColors bool   `default:"false"`
 		LogJSON        bool   `default:"false"`
-		DB             DB
-		FA             FA
-		TG             TG
+		// ShutdownTimeout is how long to wait for running jobs and queued alerts when shutting down.
+		ShutdownTimeout duration
+		DB              DB
+		FA              FA
+		TG              TG
 	}
 
 	// DB is the database configuration.
 	DB struct {
-		File string `default:"fanotify.bolt"`
+		// DeliveredTTL is how long to remember which submissions and journals each user has been sent.
+		DeliveredTTL duration
+		File         string `default:"fanotify.bolt"`
 	}
 
 	// TG is the configuration for Telegram.
 	TG struct {
-		Debug    bool   `default:"false"`
-		LogLevel string `default:"WARN"`
-		Token    string `required:"true"`
-		OwnerID  int64  `required:"true"`
+		// ChatSendRate is how many messages per second may be sent to a single chat, with bursts of up to
+		// ChatSendBurst. Messages over the limit wait their turn.
+		ChatSendRate  float64 `default:"1"`
+		ChatSendBurst int     `default:"1"`
+		Debug         bool    `default:"false"`
+		// GlobalSendRate is how many messages per second may be sent to all chats combined, with bursts of up to
+		// GlobalSendBurst.
+		GlobalSendRate  float64 `default:"30"`
+		GlobalSendBurst int     `default:"30"`
+		LogLevel        string  `default:"WARN"`
+		// MaxSendAttempts is how many times sending an alert will be tried before giving up on it.
+		MaxSendAttempts int `default:"10"`
+		// MergeWindow is how long submission alerts wait to be sent, so that everything that finds the submission
+		// can be listed in one alert. It defaults to FA.PollInterval, so every search and user is checked once in it.
+		MergeWindow duration
+		Token       string `required:"true"`
+		OwnerID     int64  `required:"true"`
 	}
 
 	// FA is the configuration for FurAffinity.
 	FA struct {
-		Cookies      []Cookie
-		PollInterval duration `required:"true"`
-		Proxy        string
-		RateLimit    duration `required:"true"`
+		Cookies []Cookie
+		// FailureAlertThreshold is how many times in a row a search or user can fail before the owner is alerted.
+		FailureAlertThreshold int `default:"5"`
+		// MaxGalleryPages is how many pages of a user's gallery will be retrieved to catch up on new submissions.
+		MaxGalleryPages int `default:"3"`
+		// MaxBackoff is the longest a failing search or user will wait between retries.
+		MaxBackoff duration
+		// MaxSearchPages is how many pages of search results will be retrieved to catch up on new results.
+		MaxSearchPages int      `default:"5"`
+		PollInterval   duration `required:"true"`
+		// PollWorkers is how many searches and users may be polled at the same time.
+		PollWorkers int `default:"4"`
+		Proxy       string
+		RateLimit   duration `required:"true"`
 		// RequestTimeout is the timeout for a single attempt at the request.
 		RequestTimeout duration
 		RetryDelay     duration
@@ -45,6 +45,24 @@ var (
 	searchesBucket = []byte("searches")
 	faUsersBucket  = []byte("fa_users")
 	tgUsersBucket  = []byte("tg_users")
+	// deliveredBucket has a nested bucket for each DeliveryNamespace.
+	deliveredBucket = []byte("delivered")
+	outboxBucket    = []byte("outbox")
+	// outboxPhotosBucket has the photos for notifications in the outbox, by the notification's ID.
+	outboxPhotosBucket = []byte("outbox_photos")
+	// outboxDueBucket indexes the outbox by when each notification is due, then its ID.
+	outboxDueBucket = []byte("outbox_due")
+	// outboxUsersBucket indexes the outbox by telegram user, then notification ID.
+	outboxUsersBucket = []byte("outbox_users")
+	// outboxSubmissionsBucket has the ID of each telegram user's notification for a submission, by user then
+	// submission ID.
+	outboxSubmissionsBucket = []byte("outbox_submissions")
+	digestBucket            = []byte("digest")
+	// digestDueBucket, digestUsersBucket and digestSubmissionsBucket index pending digest items the same way as the
+	// outbox's indexes.
+	digestDueBucket         = []byte("digest_due")
+	digestUsersBucket       = []byte("digest_users")
+	digestSubmissionsBucket = []byte("digest_submissions")
 
 	ErrCannotSaveNonIteration = errors.New("cannot save non-iteration item")
 	ErrNoTGUser               = errors.New("no such telegram user")
@@ -54,11 +72,15 @@ type (
 	// TelegramID is the type of Telegram entity IDs.
 	TelegramID int64
 
-	// UserLoader is used to load a user while iterating over saved items.
-	UserLoader func(id TelegramID) (*TGUser, error)
-
-	SearchIterator func(search *Search, ul UserLoader) error
-	UserIterator   func(faUser *FAUser, ul UserLoader) error
+	// FailureState tracks consecutive failures to poll a search or furaffinity user.
+	FailureState struct {
+		ConsecutiveFailures int       `json:"consecutive_failures"`
+		LastError           string    `json:"last_error"`
+		LastFailure         time.Time `json:"last_failure"`
+		NextRetry           time.Time `json:"next_retry"`
+		// OwnerAlerted is set once the owner has been told about the failures, so that they are only told once.
+		OwnerAlerted bool `json:"owner_alerted"`
+	}
 
 	// DB is an interface that can load and store information in a database.
 	DB interface {
@@ -66,16 +88,41 @@ type (
 
 		AddSearchForUser(userID TelegramID, search string) error
 		DeleteSearchForUser(userID TelegramID, search string) error
-		IterateSearches(cb SearchIterator) error
+		EditSearchForUser(userID TelegramID, from, to string) error
+		CanonicalizeSearches(canonical func(search string) (string, error),
+			repaired func(search string, userID TelegramID, problem error)) (int, error)
+		GetSearches() ([]*Search, error)
+		GetSearch(search string) (*Search, error)
 
-		AddUserSubmissionsForUser(userID TelegramID, faUser string) error
+		AddUserSubmissionsForUser(userID TelegramID, faUser, displayName string) error
 		DeleteUserSubmissionsForUser(userID TelegramID, faUser string) error
-		AddUserJournalsForUser(userID TelegramID, faUser string) error
+		AddUserJournalsForUser(userID TelegramID, faUser, displayName string) error
 		DeleteUserJournalsForUser(userID TelegramID, faUser string) error
-		IterateUsers(cb UserIterator) error
+		GetFAUsers() ([]*FAUser, error)
+		GetFAUser(faUser string) (*FAUser, error)
 
 		GetTGUser(id TelegramID) (*TGUser, error)
 		SaveTGUser(user *TGUser) error
+		UpdateTGUser(id TelegramID, f func(user *TGUser) error) error
+		SetSubscriptions(userID TelegramID, subs *Subscriptions, replace bool) error
+
+		MarkDelivered(ns DeliveryNamespace, userID TelegramID, id int64) (bool, error)
+		PruneDelivered(before time.Time) (int, error)
+
+		QueueNotification(n *Notification) error
+		DueNotifications(now time.Time, limit int, skip func(userID TelegramID) bool) ([]*Notification, error)
+		SaveNotification(n *Notification) error
+		MergeNotification(userID TelegramID, submissionID int64, merge func(n *Notification)) (bool, error)
+		ClaimNotification(id uint64) (*Notification, error)
+		RescheduleHeldNotifications(userID TelegramID, at time.Time) error
+		CollapseNotifications(userID TelegramID, now time.Time, summarize func(ns []*Notification) []*Notification) error
+
+		AddDigestItem(item *DigestItem) error
+		MergeDigestItem(userID TelegramID, submissionID int64, merge func(item *DigestItem)) (bool, error)
+		RescheduleDigest(userID TelegramID, due time.Time) error
+		FlushDigests(now time.Time, build func(userID TelegramID, items []*DigestItem) []*Notification) (int, error)
+		DeleteNotification(id uint64) error
+		OutboxLength() (int, error)
 	}
 
 	db struct {
@@ -120,6 +167,37 @@ func New(filename string) (DB, error) {
 			return fmt.Errorf("create telegram users bucket: %s", err)
 		}
 
+		delivered, err := tx.CreateBucketIfNotExists(deliveredBucket)
+		if err != nil {
+			return fmt.Errorf("create delivered bucket: %s", err)
+		}
+		for _, ns := range deliveryNamespaces {
+			_, err = delivered.CreateBucketIfNotExists([]byte(ns))
+			if err != nil {
+				return fmt.Errorf("create delivered %s bucket: %s", ns, err)
+			}
+		}
+
+		_, err = tx.CreateBucketIfNotExists(outboxBucket)
+		if err != nil {
+			return fmt.Errorf("create outbox bucket: %s", err)
+		}
+		for _, bucket := range [][]byte{outboxPhotosBucket, outboxDueBucket, outboxUsersBucket,
+			outboxSubmissionsBucket} {
+
+			_, err = tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return fmt.Errorf("create %s bucket: %s", bucket, err)
+			}
+		}
+
+		for _, bucket := range [][]byte{digestBucket, digestDueBucket, digestUsersBucket, digestSubmissionsBucket} {
+			_, err = tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return fmt.Errorf("create %s bucket: %s", bucket, err)
+			}
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -0,0 +1,125 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+)
+
+type (
+	// DeliveryNamespace keeps IDs of different kinds of items apart in the delivered index.
+	DeliveryNamespace string
+)
+
+// Delivery namespaces.
+const (
+	SubmissionsDelivered DeliveryNamespace = "submissions"
+	JournalsDelivered    DeliveryNamespace = "journals"
+)
+
+var (
+	deliveryNamespaces = []DeliveryNamespace{SubmissionsDelivered, JournalsDelivered}
+)
+
+// MarkDelivered records that the item with the given ID was delivered to the user. It returns false if the item had
+// already been delivered to them and has not yet been pruned.
+func (d *db) MarkDelivered(ns DeliveryNamespace, userID TelegramID, id int64) (bool, error) {
+	marked := false
+	err := d.b.Update(func(tx *bolt.Tx) error {
+		b, err := getDeliveredBucket(ns, tx)
+		if err != nil {
+			return err
+		}
+
+		k := deliveredKey(userID, id)
+		if b.Get(k) != nil {
+			return nil
+		}
+		marked = true
+		return b.Put(k, []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	})
+	return marked, err
+}
+
+// PruneDelivered removes every entry in the delivered index that was delivered before the given time, returning how
+// many were removed.
+func (d *db) PruneDelivered(before time.Time) (int, error) {
+	pruned := 0
+	err := d.b.Update(func(tx *bolt.Tx) error {
+		for _, ns := range deliveryNamespaces {
+			b, err := getDeliveredBucket(ns, tx)
+			if err != nil {
+				return err
+			}
+
+			// deleting while iterating with ForEach is not allowed, so collect them first
+			var expired [][]byte
+			err = b.ForEach(func(k, v []byte) error {
+				ts, err := strconv.ParseInt(string(v), 10, 64)
+				// if it's unparseable it's useless, so get rid of it too
+				if err != nil || time.Unix(ts, 0).Before(before) {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			pruned += len(expired)
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+func getDeliveredBucket(ns DeliveryNamespace, tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket(deliveredBucket)
+	if b == nil {
+		return nil, errors.New("could not load delivered bucket")
+	}
+	nb := b.Bucket([]byte(ns))
+	if nb == nil {
+		return nil, errors.New("could not load delivered " + string(ns) + " bucket")
+	}
+	return nb, nil
+}
+
+func deliveredKey(userID TelegramID, id int64) []byte {
+	return []byte(string(userID.Key()) + ":" + strconv.FormatInt(id, 10))
+}
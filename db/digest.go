@@ -0,0 +1,350 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+)
+
+type (
+	// DeliveryMode is how a telegram user wants to get their alerts.
+	DeliveryMode string
+
+	// DigestItem is an alert waiting to be sent to a telegram user in their next digest.
+	DigestItem struct {
+		ID     uint64     `json:"id"`
+		UserID TelegramID `json:"user_id"`
+		// Trigger is HTML describing the subscription that found the item, which items are grouped by.
+		Trigger string `json:"trigger"`
+		// SubmissionID is the submission the item is for, if it is one.
+		SubmissionID int64     `json:"submission_id,omitempty"`
+		Title        string    `json:"title"`
+		User         string    `json:"user"`
+		Rating       string    `json:"rating,omitempty"`
+		Link         string    `json:"link"`
+		PhotoURL     string    `json:"photo_url,omitempty"`
+		Created      time.Time `json:"created"`
+		// Due is when the digest this item is in should be sent.
+		Due time.Time `json:"due"`
+	}
+)
+
+// Delivery modes.
+const (
+	DeliverImmediately DeliveryMode = ""
+	DeliverHourly      DeliveryMode = "hourly"
+	DeliverDaily       DeliveryMode = "daily"
+)
+
+// AddDigestItem adds the item to the user's pending digest, assigning its ID.
+func (d *db) AddDigestItem(item *DigestItem) error {
+	return d.b.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(digestBucket)
+		if b == nil {
+			return errors.New("could not load digest bucket")
+		}
+
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		item.ID = id
+		if item.Created.IsZero() {
+			item.Created = time.Now()
+		}
+		return saveDigestItem(item, tx)
+	})
+}
+
+// MergeDigestItem lets merge change the user's pending digest item for the submission, if they have one, all in one
+// transaction. Returns whether there was one.
+func (d *db) MergeDigestItem(userID TelegramID, submissionID int64, merge func(item *DigestItem)) (bool, error) {
+	found := false
+	err := d.b.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(digestSubmissionsBucket)
+		if b == nil {
+			return errors.New("could not load digest submissions bucket")
+		}
+
+		v := b.Get(submissionNotificationKey(userID, submissionID))
+		if v == nil {
+			return nil
+		}
+		item, err := getDigestItem(binary.BigEndian.Uint64(v), tx)
+		if err != nil || item == nil {
+			return err
+		}
+
+		found = true
+		merge(item)
+		return saveDigestItem(item, tx)
+	})
+	return found, err
+}
+
+// RescheduleDigest changes when all of the user's pending digest items are due.
+func (d *db) RescheduleDigest(userID TelegramID, due time.Time) error {
+	return d.b.Update(func(tx *bolt.Tx) error {
+		items, err := getUserDigestItems(userID, tx)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			item.Due = due
+			err = saveDigestItem(item, tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FlushDigests moves the digest items that are due by the given time into the outbox, as whatever notifications build
+// makes out of each user's items, all in one transaction. Items by artists the user has blocked since they were found
+// are dropped. Returns how many users had a digest.
+func (d *db) FlushDigests(now time.Time, build func(userID TelegramID, items []*DigestItem) []*Notification) (int,
+	error) {
+
+	flushed := 0
+	err := d.b.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(digestDueBucket)
+		if b == nil {
+			return errors.New("could not load digest due bucket")
+		}
+
+		// find who has anything due, soonest first
+		var users []TelegramID
+		seen := make(map[TelegramID]bool)
+		end := dueKey(now, math.MaxUint64)
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) <= 0; k, _ = c.Next() {
+			item, err := getDigestItem(binary.BigEndian.Uint64(k[8:]), tx)
+			if err != nil {
+				return err
+			}
+			if item == nil {
+				return fmt.Errorf("digest due index has missing item %x", k)
+			}
+			if !seen[item.UserID] {
+				seen[item.UserID] = true
+				users = append(users, item.UserID)
+			}
+		}
+
+		outbox := tx.Bucket(outboxBucket)
+		if outbox == nil {
+			return errors.New("could not load outbox bucket")
+		}
+		for _, userID := range users {
+			user, err := getTGUser(userID, tx)
+			if err != nil {
+				return err
+			}
+			// keep the user's items in the order they were found
+			items, err := getUserDigestItems(userID, tx)
+			if err != nil {
+				return err
+			}
+			var wanted []*DigestItem
+			for _, item := range items {
+				if item.Due.After(now) {
+					continue
+				}
+				err = deleteDigestItem(item, tx)
+				if err != nil {
+					return err
+				}
+				if user == nil || !user.Blocked(item.User) {
+					wanted = append(wanted, item)
+				}
+			}
+			if len(wanted) == 0 {
+				continue
+			}
+
+			for _, n := range build(userID, wanted) {
+				n.ID, err = outbox.NextSequence()
+				if err != nil {
+					return err
+				}
+				if n.Created.IsZero() {
+					n.Created = now
+				}
+				err = saveNotification(n, tx)
+				if err != nil {
+					return err
+				}
+			}
+			flushed++
+		}
+		return nil
+	})
+	return flushed, err
+}
+
+// getUserDigestItems loads all of the user's pending digest items, in the order they were found.
+func getUserDigestItems(userID TelegramID, tx *bolt.Tx) ([]*DigestItem, error) {
+	b := tx.Bucket(digestUsersBucket)
+	if b == nil {
+		return nil, errors.New("could not load digest users bucket")
+	}
+
+	var items []*DigestItem
+	prefix := telegramIDKey(userID)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		item, err := getDigestItem(binary.BigEndian.Uint64(k[8:]), tx)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func getDigestItem(id uint64, tx *bolt.Tx) (*DigestItem, error) {
+	b := tx.Bucket(digestBucket)
+	if b == nil {
+		return nil, errors.New("could not load digest bucket")
+	}
+
+	data := b.Get(notificationKey(id))
+	if data == nil {
+		return nil, nil
+	}
+	item := &DigestItem{}
+	err := json.Unmarshal(data, item)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalling digest item: %s", err)
+	}
+	return item, nil
+}
+
+// saveDigestItem saves the item and keeps the digest's indexes up to date.
+func saveDigestItem(item *DigestItem, tx *bolt.Tx) error {
+	b := tx.Bucket(digestBucket)
+	if b == nil {
+		return errors.New("could not load digest bucket")
+	}
+
+	old, err := getDigestItem(item.ID, tx)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		err = unindexDigestItem(old, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("marshalling digest item: %s", err)
+	}
+
+	// these are ordered the same way as the outbox
+	err = b.Put(notificationKey(item.ID), data)
+	if err != nil {
+		return err
+	}
+	return indexDigestItem(item, tx)
+}
+
+func deleteDigestItem(item *DigestItem, tx *bolt.Tx) error {
+	err := unindexDigestItem(item, tx)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(digestBucket).Delete(notificationKey(item.ID))
+}
+
+// indexDigestItem adds the item to the digest's indexes, which are kept the same way as the outbox's: by when it is
+// due, by user, and by user and submission for submission alerts.
+func indexDigestItem(item *DigestItem, tx *bolt.Tx) error {
+	due, users, subs, err := digestIndexes(tx)
+	if err != nil {
+		return err
+	}
+
+	err = due.Put(dueKey(item.Due, item.ID), []byte{})
+	if err != nil {
+		return err
+	}
+	err = users.Put(userNotificationKey(item.UserID, item.ID), []byte{})
+	if err != nil {
+		return err
+	}
+	if item.SubmissionID != 0 {
+		return subs.Put(submissionNotificationKey(item.UserID, item.SubmissionID), notificationKey(item.ID))
+	}
+	return nil
+}
+
+func unindexDigestItem(item *DigestItem, tx *bolt.Tx) error {
+	due, users, subs, err := digestIndexes(tx)
+	if err != nil {
+		return err
+	}
+
+	err = due.Delete(dueKey(item.Due, item.ID))
+	if err != nil {
+		return err
+	}
+	err = users.Delete(userNotificationKey(item.UserID, item.ID))
+	if err != nil {
+		return err
+	}
+	if item.SubmissionID != 0 {
+		return subs.Delete(submissionNotificationKey(item.UserID, item.SubmissionID))
+	}
+	return nil
+}
+
+func digestIndexes(tx *bolt.Tx) (due, users, subs *bolt.Bucket, err error) {
+	due = tx.Bucket(digestDueBucket)
+	users = tx.Bucket(digestUsersBucket)
+	subs = tx.Bucket(digestSubmissionsBucket)
+	if due == nil || users == nil || subs == nil {
+		return nil, nil, nil, errors.New("could not load digest index buckets")
+	}
+	return due, users, subs, nil
+}
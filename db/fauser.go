@@ -40,15 +40,17 @@ import (
 
 type (
 	FAUser struct {
-		// Set during iteration to allow the user to be saved.
-		tx *bolt.Tx
-		// TODO have a way to get and store the preferred case of the username
+		// Set when loaded for polling to allow the user's progress to be saved.
+		d *db
+		// Username is always lower case, since it is used as the key. DisplayName is the user's preferred case.
 		Username         string              `json:"username"`
+		DisplayName      string              `json:"display_name,omitempty"`
 		LastRun          time.Time           `json:"last_run"`
 		LastSubmissionID int64               `json:"last_submission_id"`
 		LastJournalID    int64               `json:"last_journal_id"`
 		SubmissionUsers  map[TelegramID]bool `json:"submission_users"`
 		JournalUsers     map[TelegramID]bool `json:"journal_users"`
+		FailureState
 	}
 )
 
@@ -56,218 +58,270 @@ var (
 	ErrNoFAUser = errors.New("no such furaffinity user")
 )
 
-func (d *db) AddUserSubmissionsForUser(userID TelegramID, faUser string) error {
-	faUser = strings.ToLower(faUser)
+// Name returns the user's name in their preferred case, if we know it.
+func (u *FAUser) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+// AddUserSubmissionsForUser adds the furaffinity user to the user's submissions alerts, creating the furaffinity user if
+// needed. If displayName is not empty, it replaces the furaffinity user's display name.
+func (d *db) AddUserSubmissionsForUser(userID TelegramID, faUser, displayName string) error {
 	return d.b.Update(func(tx *bolt.Tx) error {
-		// Add the user to the fa user, creating it if needed.
-		fa, err := getFAUser(faUser, tx)
-		if err != nil {
-			return err
-		}
+		return addUserSubmissionsForUser(userID, faUser, displayName, tx)
+	})
+}
 
-		if fa == nil {
-			fa = &FAUser{
-				Username:         faUser,
-				LastRun:          time.Unix(0, 0),
-				LastJournalID:    0,
-				LastSubmissionID: 0,
-				JournalUsers:     map[TelegramID]bool{},
-				SubmissionUsers:  map[TelegramID]bool{},
-			}
-		}
+func addUserSubmissionsForUser(userID TelegramID, faUser, displayName string, tx *bolt.Tx) error {
+	faUser = strings.ToLower(faUser)
 
-		fa.SubmissionUsers[userID] = true
-		err = saveFAUser(fa, tx)
-		if err != nil {
-			return err
-		}
+	// Add the user to the fa user, creating it if needed.
+	fa, err := getFAUser(faUser, tx)
+	if err != nil {
+		return err
+	}
 
-		// Add the fa user to the user.
-		user, err := getTGUser(userID, tx)
-		if err != nil {
-			return err
-		}
-		if user == nil {
-			return ErrNoTGUser
+	if fa == nil {
+		fa = &FAUser{
+			Username:         faUser,
+			LastRun:          time.Unix(0, 0),
+			LastJournalID:    0,
+			LastSubmissionID: 0,
+			JournalUsers:     map[TelegramID]bool{},
+			SubmissionUsers:  map[TelegramID]bool{},
 		}
-		if user.SubmissionUsers == nil {
-			user.SubmissionUsers = make(map[string]bool)
-		}
-		user.SubmissionUsers[faUser] = true
-		return saveTGUser(user, tx)
-	})
+	}
+	if displayName != "" {
+		fa.DisplayName = displayName
+	}
+
+	fa.SubmissionUsers[userID] = true
+	err = saveFAUser(fa, tx)
+	if err != nil {
+		return err
+	}
+
+	// Add the fa user to the user.
+	user, err := getTGUser(userID, tx)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrNoTGUser
+	}
+	if user.SubmissionUsers == nil {
+		user.SubmissionUsers = make(map[string]bool)
+	}
+	user.SubmissionUsers[faUser] = true
+	return saveTGUser(user, tx)
 }
 
 func (d *db) DeleteUserSubmissionsForUser(userID TelegramID, faUser string) error {
-	faUser = strings.ToLower(faUser)
 	return d.b.Update(func(tx *bolt.Tx) error {
-		// Delete the user from the fa user.
-		fa, err := getFAUser(faUser, tx)
-		if err != nil {
-			return err
-		}
-		if fa == nil {
-			return ErrNoFAUser
-		}
-		existed := fa.SubmissionUsers[userID]
+		return deleteUserSubmissionsForUser(userID, faUser, tx)
+	})
+}
 
-		delete(fa.SubmissionUsers, userID)
-		if len(fa.SubmissionUsers) == 0 {
-			b := tx.Bucket(faUsersBucket)
-			if b == nil {
-				return errors.New("could not load furaffinity users bucket")
-			}
-			err = b.Delete([]byte(faUser))
-		} else {
-			err = saveFAUser(fa, tx)
-		}
-		if err != nil {
-			return err
-		}
+func deleteUserSubmissionsForUser(userID TelegramID, faUser string, tx *bolt.Tx) error {
+	faUser = strings.ToLower(faUser)
 
-		// Delete the fa user from the user.
-		user, err := getTGUser(userID, tx)
-		if err != nil {
-			return err
-		}
-		if user == nil {
-			return ErrNoTGUser
-		}
-		if user.SubmissionUsers == nil {
-			user.SubmissionUsers = make(map[string]bool)
-		}
-		existed = existed && user.SubmissionUsers[faUser]
-		delete(user.SubmissionUsers, faUser)
-		err = saveTGUser(user, tx)
-		if err != nil {
-			return err
-		}
+	// Delete the user from the fa user.
+	fa, err := getFAUser(faUser, tx)
+	if err != nil {
+		return err
+	}
+	if fa == nil {
+		return ErrNoFAUser
+	}
+	existed := fa.SubmissionUsers[userID]
 
-		if !existed {
-			return ErrNoFAUser
+	delete(fa.SubmissionUsers, userID)
+	if len(fa.SubmissionUsers) == 0 {
+		b := tx.Bucket(faUsersBucket)
+		if b == nil {
+			return errors.New("could not load furaffinity users bucket")
 		}
-		return nil
+		err = b.Delete([]byte(faUser))
+	} else {
+		err = saveFAUser(fa, tx)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Delete the fa user from the user.
+	user, err := getTGUser(userID, tx)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrNoTGUser
+	}
+	if user.SubmissionUsers == nil {
+		user.SubmissionUsers = make(map[string]bool)
+	}
+	existed = existed && user.SubmissionUsers[faUser]
+	delete(user.SubmissionUsers, faUser)
+	delete(user.SubmissionUserSettings, faUser)
+	err = saveTGUser(user, tx)
+	if err != nil {
+		return err
+	}
+
+	if !existed {
+		return ErrNoFAUser
+	}
+	return nil
+}
+
+// AddUserJournalsForUser adds the furaffinity user to the user's journals alerts, creating the furaffinity user if
+// needed. If displayName is not empty, it replaces the furaffinity user's display name.
+func (d *db) AddUserJournalsForUser(userID TelegramID, faUser, displayName string) error {
+	return d.b.Update(func(tx *bolt.Tx) error {
+		return addUserJournalsForUser(userID, faUser, displayName, tx)
 	})
 }
 
-func (d *db) AddUserJournalsForUser(userID TelegramID, faUser string) error {
+func addUserJournalsForUser(userID TelegramID, faUser, displayName string, tx *bolt.Tx) error {
 	faUser = strings.ToLower(faUser)
-	return d.b.Update(func(tx *bolt.Tx) error {
-		// Add the user to the fa user, creating it if needed.
-		fa, err := getFAUser(faUser, tx)
-		if err != nil {
-			return err
-		}
 
-		if fa == nil {
-			fa = &FAUser{
-				Username:         faUser,
-				LastRun:          time.Unix(0, 0),
-				LastJournalID:    0,
-				LastSubmissionID: 0,
-				JournalUsers:     map[TelegramID]bool{},
-				SubmissionUsers:  map[TelegramID]bool{},
-			}
-		}
+	// Add the user to the fa user, creating it if needed.
+	fa, err := getFAUser(faUser, tx)
+	if err != nil {
+		return err
+	}
 
-		fa.JournalUsers[userID] = true
-		err = saveFAUser(fa, tx)
-		if err != nil {
-			return err
+	if fa == nil {
+		fa = &FAUser{
+			Username:         faUser,
+			LastRun:          time.Unix(0, 0),
+			LastJournalID:    0,
+			LastSubmissionID: 0,
+			JournalUsers:     map[TelegramID]bool{},
+			SubmissionUsers:  map[TelegramID]bool{},
 		}
+	}
+	if displayName != "" {
+		fa.DisplayName = displayName
+	}
 
-		// Add the fa user to the user.
-		user, err := getTGUser(userID, tx)
-		if err != nil {
-			return err
-		}
-		if user == nil {
-			return ErrNoTGUser
-		}
-		if user.JournalUsers == nil {
-			user.JournalUsers = make(map[string]bool)
-		}
-		user.JournalUsers[faUser] = true
-		return saveTGUser(user, tx)
-	})
+	fa.JournalUsers[userID] = true
+	err = saveFAUser(fa, tx)
+	if err != nil {
+		return err
+	}
+
+	// Add the fa user to the user.
+	user, err := getTGUser(userID, tx)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrNoTGUser
+	}
+	if user.JournalUsers == nil {
+		user.JournalUsers = make(map[string]bool)
+	}
+	user.JournalUsers[faUser] = true
+	return saveTGUser(user, tx)
 }
 
 func (d *db) DeleteUserJournalsForUser(userID TelegramID, faUser string) error {
-	faUser = strings.ToLower(faUser)
 	return d.b.Update(func(tx *bolt.Tx) error {
-		// Delete the user from the fa user.
-		fa, err := getFAUser(faUser, tx)
-		if err != nil {
-			return err
-		}
-		if fa == nil {
-			return ErrNoFAUser
-		}
-		existed := fa.JournalUsers[userID]
+		return deleteUserJournalsForUser(userID, faUser, tx)
+	})
+}
 
-		delete(fa.JournalUsers, userID)
-		if len(fa.JournalUsers) == 0 {
-			b := tx.Bucket(faUsersBucket)
-			if b == nil {
-				return errors.New("could not load furaffinity users bucket")
-			}
-			err = b.Delete([]byte(faUser))
-		} else {
-			err = saveFAUser(fa, tx)
-		}
-		if err != nil {
-			return err
-		}
+func deleteUserJournalsForUser(userID TelegramID, faUser string, tx *bolt.Tx) error {
+	faUser = strings.ToLower(faUser)
 
-		// Delete the fa user from the user.
-		user, err := getTGUser(userID, tx)
-		if err != nil {
-			return err
-		}
-		if user == nil {
-			return ErrNoTGUser
-		}
-		if user.JournalUsers == nil {
-			user.JournalUsers = make(map[string]bool)
-		}
-		existed = existed && user.JournalUsers[faUser]
-		delete(user.JournalUsers, faUser)
-		err = saveTGUser(user, tx)
-		if err != nil {
-			return err
-		}
+	// Delete the user from the fa user.
+	fa, err := getFAUser(faUser, tx)
+	if err != nil {
+		return err
+	}
+	if fa == nil {
+		return ErrNoFAUser
+	}
+	existed := fa.JournalUsers[userID]
 
-		if !existed {
-			return ErrNoFAUser
+	delete(fa.JournalUsers, userID)
+	if len(fa.JournalUsers) == 0 {
+		b := tx.Bucket(faUsersBucket)
+		if b == nil {
+			return errors.New("could not load furaffinity users bucket")
 		}
-		return nil
-	})
+		err = b.Delete([]byte(faUser))
+	} else {
+		err = saveFAUser(fa, tx)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Delete the fa user from the user.
+	user, err := getTGUser(userID, tx)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrNoTGUser
+	}
+	if user.JournalUsers == nil {
+		user.JournalUsers = make(map[string]bool)
+	}
+	existed = existed && user.JournalUsers[faUser]
+	delete(user.JournalUsers, faUser)
+	delete(user.JournalUserSettings, faUser)
+	err = saveTGUser(user, tx)
+	if err != nil {
+		return err
+	}
+
+	if !existed {
+		return ErrNoFAUser
+	}
+	return nil
 }
 
-func (d *db) IterateUsers(cb UserIterator) error {
-	return d.b.Update(func(tx *bolt.Tx) error {
+// GetFAUsers loads every furaffinity user. The returned users were not loaded via iteration, so they cannot be saved
+// with Update.
+func (d *db) GetFAUsers() ([]*FAUser, error) {
+	var users []*FAUser
+	err := d.b.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(faUsersBucket)
 		if b == nil {
 			return errors.New("could not load furaffinity users bucket")
 		}
 
-		ul := func(id TelegramID) (*TGUser, error) {
-			return getTGUser(id, tx)
-		}
-
 		return b.ForEach(func(k, v []byte) error {
 			fa := &FAUser{}
 			err := json.Unmarshal(v, fa)
 			if err != nil {
 				return fmt.Errorf("unmarshalling furaffinity user: %s", err)
 			}
-			fa.tx = tx
-
-			// TODO maybe we shouldn't immediately return the error from the callback?
-			// If it's a transient FA error, we probably should keep trying the rest.
-			return cb(fa, ul)
+			users = append(users, fa)
+			return nil
 		})
 	})
+	return users, err
+}
+
+// GetFAUser loads a single furaffinity user without holding a transaction open, so that they can be polled. Their
+// progress can be saved afterwards with Update. Returns nil if the user does not exist.
+func (d *db) GetFAUser(faUser string) (*FAUser, error) {
+	var fa *FAUser
+	err := d.b.View(func(tx *bolt.Tx) error {
+		var err error
+		fa, err = getFAUser(strings.ToLower(faUser), tx)
+		return err
+	})
+	if fa != nil {
+		fa.d = d
+	}
+	return fa, err
 }
 
 func getFAUser(user string, tx *bolt.Tx) (*FAUser, error) {
@@ -302,12 +356,29 @@ func saveFAUser(user *FAUser, tx *bolt.Tx) error {
 	return b.Put([]byte(user.Username), data)
 }
 
-// Update saves the current state of the user back to the database, if the user was loaded via iteration.
-// Otherwise, ErrCannotSaveNonIteration is returned.
+// Update saves the polling progress of the user (LastRun, LastSubmissionID, LastJournalID, FailureState, and
+// DisplayName) back to the database, if the user was loaded with GetFAUser. Otherwise, ErrCannotSaveNonIteration is returned.
+// Everything else is left as it currently is in the database, since telegram users may have been added or removed while
+// the user was being checked. If the user was deleted in the meantime, ErrNoFAUser is returned and nothing is saved.
 func (u *FAUser) Update() error {
-	if u.tx == nil {
+	if u.d == nil {
 		return ErrCannotSaveNonIteration
 	}
 
-	return saveFAUser(u, u.tx)
+	return u.d.b.Update(func(tx *bolt.Tx) error {
+		current, err := getFAUser(u.Username, tx)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return ErrNoFAUser
+		}
+
+		current.LastRun = u.LastRun
+		current.LastSubmissionID = u.LastSubmissionID
+		current.LastJournalID = u.LastJournalID
+		current.FailureState = u.FailureState
+		current.DisplayName = u.DisplayName
+		return saveFAUser(current, tx)
+	})
 }
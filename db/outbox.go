@@ -0,0 +1,509 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+)
+
+type (
+	// Notification is an alert waiting in the outbox to be sent to a telegram user.
+	Notification struct {
+		ID     uint64     `json:"id"`
+		UserID TelegramID `json:"user_id"`
+		// Text is HTML, and is used as the caption if there is a photo.
+		Text      string `json:"text"`
+		PhotoName string `json:"photo_name,omitempty"`
+		// Photo is kept separately from the rest of the notification, and is only loaded when it is due to be sent.
+		Photo       []byte    `json:"-"`
+		Created     time.Time `json:"created"`
+		Attempts    int       `json:"attempts"`
+		NextAttempt time.Time `json:"next_attempt"`
+		// Held notifications are being kept back until NextAttempt for the user's sake, rather than because sending
+		// them failed.
+		Held bool `json:"held,omitempty"`
+		// Collapse notifications are sent as part of a summary with the user's other due Collapse notifications,
+		// instead of on their own.
+		Collapse bool `json:"collapse,omitempty"`
+		// Album is sent as a group of photos, fetched by Telegram from their URLs, instead of Text.
+		Album []AlbumPhoto `json:"album,omitempty"`
+		// Artist is who the alert is about, so the user can block them from it.
+		Artist string `json:"artist,omitempty"`
+
+		// SubmissionID is the submission a submission alert is for, so that other triggers that find it before it is
+		// sent can be added to it instead of being dropped.
+		SubmissionID int64 `json:"submission_id,omitempty"`
+		// Triggers are everything that found the submission, which Text lists before Body.
+		Triggers []Trigger `json:"triggers,omitempty"`
+		// Body is HTML describing the submission.
+		Body string `json:"body,omitempty"`
+	}
+
+	// Trigger is one of the reasons a submission alert was sent.
+	Trigger struct {
+		Kind TriggerKind `json:"kind"`
+		// Name is the search, or the artist's name.
+		Name string `json:"name"`
+	}
+
+	// TriggerKind is the kind of subscription that found a submission.
+	TriggerKind string
+
+	// AlbumPhoto is one of the photos in an album notification.
+	AlbumPhoto struct {
+		URL string `json:"url"`
+		// Caption is HTML.
+		Caption string `json:"caption"`
+	}
+)
+
+// Trigger kinds.
+const (
+	SearchTrigger TriggerKind = "search"
+	ArtistTrigger TriggerKind = "artist"
+)
+
+// QueueNotification adds the notification to the end of the outbox, assigning its ID.
+func (d *db) QueueNotification(n *Notification) error {
+	return d.b.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if b == nil {
+			return errors.New("could not load outbox bucket")
+		}
+
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		n.ID = id
+		if n.Created.IsZero() {
+			n.Created = time.Now()
+		}
+		return saveNotification(n, tx)
+	})
+}
+
+// DueNotifications loads up to limit notifications from the outbox that are due to be sent by the given time, without
+// their photos, soonest due first. Notifications for users that skip returns true for are left out.
+func (d *db) DueNotifications(now time.Time, limit int, skip func(userID TelegramID) bool) ([]*Notification,
+	error) {
+
+	var ns []*Notification
+	err := d.b.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxDueBucket)
+		if b == nil {
+			return errors.New("could not load outbox due bucket")
+		}
+
+		end := dueKey(now, math.MaxUint64)
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && len(ns) < limit && bytes.Compare(k, end) <= 0; k, _ = c.Next() {
+			n, err := getNotification(binary.BigEndian.Uint64(k[8:]), tx)
+			if err != nil {
+				return err
+			}
+			if n == nil {
+				return fmt.Errorf("outbox due index has missing notification %x", k)
+			}
+			if !skip(n.UserID) {
+				ns = append(ns, n)
+			}
+		}
+		return nil
+	})
+	return ns, err
+}
+
+// MergeNotification lets merge change the user's notification for the submission if it is still in the outbox, all in
+// one transaction. Returns whether there was one.
+func (d *db) MergeNotification(userID TelegramID, submissionID int64, merge func(n *Notification)) (bool, error) {
+	found := false
+	err := d.b.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxSubmissionsBucket)
+		if b == nil {
+			return errors.New("could not load outbox submissions bucket")
+		}
+
+		v := b.Get(submissionNotificationKey(userID, submissionID))
+		if v == nil {
+			return nil
+		}
+		n, err := getNotification(binary.BigEndian.Uint64(v), tx)
+		if err != nil || n == nil {
+			return err
+		}
+
+		found = true
+		merge(n)
+		return saveNotification(n, tx)
+	})
+	return found, err
+}
+
+// ClaimNotification loads the notification with its photo to be sent, and stops anything else from being merged into
+// it, all in one transaction. Returns nil if it isn't in the outbox anymore. If it isn't sent after all, saving it
+// again lets merges find it again.
+func (d *db) ClaimNotification(id uint64) (*Notification, error) {
+	var n *Notification
+	err := d.b.Update(func(tx *bolt.Tx) error {
+		var err error
+		n, err = getNotification(id, tx)
+		if err != nil || n == nil {
+			return err
+		}
+
+		if n.SubmissionID != 0 {
+			_, _, subs, err := outboxIndexes(tx)
+			if err != nil {
+				return err
+			}
+			err = subs.Delete(submissionNotificationKey(n.UserID, n.SubmissionID))
+			if err != nil {
+				return err
+			}
+		}
+
+		n.Photo, err = getNotificationPhoto(id, tx)
+		return err
+	})
+	return n, err
+}
+
+// RescheduleHeldNotifications changes when all of the user's held notifications will be sent. If at is not after now,
+// they are no longer held.
+func (d *db) RescheduleHeldNotifications(userID TelegramID, at time.Time) error {
+	return d.b.Update(func(tx *bolt.Tx) error {
+		ns, err := getUserNotifications(userID, tx)
+		if err != nil {
+			return err
+		}
+
+		release := !at.After(time.Now())
+		for _, n := range ns {
+			if !n.Held {
+				continue
+			}
+			n.NextAttempt = at
+			n.Held = !release
+			err = saveNotification(n, tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CollapseNotifications replaces the user's Collapse notifications that are due by the given time with what summarize
+// returns for them, all in one transaction.
+func (d *db) CollapseNotifications(userID TelegramID, now time.Time,
+	summarize func(ns []*Notification) []*Notification) error {
+
+	return d.b.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if b == nil {
+			return errors.New("could not load outbox bucket")
+		}
+
+		ns, err := getUserNotifications(userID, tx)
+		if err != nil {
+			return err
+		}
+		var collapse []*Notification
+		for _, n := range ns {
+			if n.Collapse && !n.NextAttempt.After(now) {
+				collapse = append(collapse, n)
+			}
+		}
+		if len(collapse) == 0 {
+			return nil
+		}
+
+		summaries := summarize(collapse)
+		for _, n := range collapse {
+			err = deleteNotification(n.ID, tx)
+			if err != nil {
+				return err
+			}
+		}
+		for _, n := range summaries {
+			n.ID, err = b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if n.Created.IsZero() {
+				n.Created = now
+			}
+			err = saveNotification(n, tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// OutboxLength counts the notifications in the outbox, including those that aren't due yet.
+func (d *db) OutboxLength() (int, error) {
+	length := 0
+	err := d.b.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if b == nil {
+			return errors.New("could not load outbox bucket")
+		}
+		length = b.Stats().KeyN
+		return nil
+	})
+	return length, err
+}
+
+// SaveNotification saves changes to a notification that is already in the outbox.
+func (d *db) SaveNotification(n *Notification) error {
+	return d.b.Update(func(tx *bolt.Tx) error {
+		return saveNotification(n, tx)
+	})
+}
+
+// DeleteNotification removes a notification from the outbox.
+func (d *db) DeleteNotification(id uint64) error {
+	return d.b.Update(func(tx *bolt.Tx) error {
+		return deleteNotification(id, tx)
+	})
+}
+
+// getNotification loads a notification from the outbox, without its photo. Returns nil if it does not exist.
+func getNotification(id uint64, tx *bolt.Tx) (*Notification, error) {
+	b := tx.Bucket(outboxBucket)
+	if b == nil {
+		return nil, errors.New("could not load outbox bucket")
+	}
+
+	data := b.Get(notificationKey(id))
+	if data == nil {
+		return nil, nil
+	}
+	n := &Notification{}
+	err := json.Unmarshal(data, n)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalling notification: %s", err)
+	}
+	return n, nil
+}
+
+func getNotificationPhoto(id uint64, tx *bolt.Tx) ([]byte, error) {
+	b := tx.Bucket(outboxPhotosBucket)
+	if b == nil {
+		return nil, errors.New("could not load outbox photos bucket")
+	}
+
+	photo := b.Get(notificationKey(id))
+	if photo == nil {
+		return nil, nil
+	}
+	// bolt's copy is only good until the transaction ends
+	return append([]byte(nil), photo...), nil
+}
+
+// getUserNotifications loads all of the user's notifications in the outbox, without their photos, in the order they
+// were queued.
+func getUserNotifications(userID TelegramID, tx *bolt.Tx) ([]*Notification, error) {
+	b := tx.Bucket(outboxUsersBucket)
+	if b == nil {
+		return nil, errors.New("could not load outbox users bucket")
+	}
+
+	var ns []*Notification
+	prefix := telegramIDKey(userID)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		n, err := getNotification(binary.BigEndian.Uint64(k[8:]), tx)
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			ns = append(ns, n)
+		}
+	}
+	return ns, nil
+}
+
+// saveNotification saves the notification and keeps the outbox's indexes up to date. The photo is only saved if the
+// notification has one loaded, so that notifications loaded without it can be saved without losing it.
+func saveNotification(n *Notification, tx *bolt.Tx) error {
+	b := tx.Bucket(outboxBucket)
+	if b == nil {
+		return errors.New("could not load outbox bucket")
+	}
+
+	old, err := getNotification(n.ID, tx)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		err = unindexNotification(old, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("marshalling notification: %s", err)
+	}
+	err = b.Put(notificationKey(n.ID), data)
+	if err != nil {
+		return err
+	}
+
+	if len(n.Photo) > 0 {
+		photos := tx.Bucket(outboxPhotosBucket)
+		if photos == nil {
+			return errors.New("could not load outbox photos bucket")
+		}
+		err = photos.Put(notificationKey(n.ID), n.Photo)
+		if err != nil {
+			return err
+		}
+	}
+	return indexNotification(n, tx)
+}
+
+func deleteNotification(id uint64, tx *bolt.Tx) error {
+	n, err := getNotification(id, tx)
+	if err != nil || n == nil {
+		return err
+	}
+	err = unindexNotification(n, tx)
+	if err != nil {
+		return err
+	}
+
+	photos := tx.Bucket(outboxPhotosBucket)
+	if photos == nil {
+		return errors.New("could not load outbox photos bucket")
+	}
+	err = photos.Delete(notificationKey(id))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(outboxBucket).Delete(notificationKey(id))
+}
+
+// indexNotification adds the notification to the outbox's indexes: by when it is due, by user, and by user and
+// submission for submission alerts.
+func indexNotification(n *Notification, tx *bolt.Tx) error {
+	due, users, subs, err := outboxIndexes(tx)
+	if err != nil {
+		return err
+	}
+
+	err = due.Put(dueKey(n.NextAttempt, n.ID), []byte{})
+	if err != nil {
+		return err
+	}
+	err = users.Put(userNotificationKey(n.UserID, n.ID), []byte{})
+	if err != nil {
+		return err
+	}
+	if n.SubmissionID != 0 {
+		return subs.Put(submissionNotificationKey(n.UserID, n.SubmissionID), notificationKey(n.ID))
+	}
+	return nil
+}
+
+func unindexNotification(n *Notification, tx *bolt.Tx) error {
+	due, users, subs, err := outboxIndexes(tx)
+	if err != nil {
+		return err
+	}
+
+	err = due.Delete(dueKey(n.NextAttempt, n.ID))
+	if err != nil {
+		return err
+	}
+	err = users.Delete(userNotificationKey(n.UserID, n.ID))
+	if err != nil {
+		return err
+	}
+	if n.SubmissionID != 0 {
+		return subs.Delete(submissionNotificationKey(n.UserID, n.SubmissionID))
+	}
+	return nil
+}
+
+func outboxIndexes(tx *bolt.Tx) (due, users, subs *bolt.Bucket, err error) {
+	due = tx.Bucket(outboxDueBucket)
+	users = tx.Bucket(outboxUsersBucket)
+	subs = tx.Bucket(outboxSubmissionsBucket)
+	if due == nil || users == nil || subs == nil {
+		return nil, nil, nil, errors.New("could not load outbox index buckets")
+	}
+	return due, users, subs, nil
+}
+
+// notificationKey is big-endian so that the outbox is iterated in the order notifications were queued.
+func notificationKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// dueKey sorts notifications by when they are due, then by the order they were queued. Notifications that are due
+// right away sort first.
+func dueKey(at time.Time, id uint64) []byte {
+	k := make([]byte, 16)
+	if at.Unix() > 0 {
+		binary.BigEndian.PutUint64(k, uint64(at.UnixNano()))
+	}
+	binary.BigEndian.PutUint64(k[8:], id)
+	return k
+}
+
+func telegramIDKey(id TelegramID) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(id))
+	return k
+}
+
+func userNotificationKey(userID TelegramID, id uint64) []byte {
+	return append(telegramIDKey(userID), notificationKey(id)...)
+}
+
+func submissionNotificationKey(userID TelegramID, submissionID int64) []byte {
+	k := telegramIDKey(userID)
+	return append(k, notificationKey(uint64(submissionID))...)
+}
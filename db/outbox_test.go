@@ -0,0 +1,151 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testDB opens a new database that is removed when the test is done.
+func testDB(t *testing.T) DB {
+	d, err := New(filepath.Join(t.TempDir(), "fanotify.db"))
+	if err != nil {
+		t.Fatalf("Unable to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	return d
+}
+
+func TestMergeNotification(t *testing.T) {
+	cat := Trigger{Kind: SearchTrigger, Name: "cat"}
+	fox := Trigger{Kind: ArtistTrigger, Name: "Fox"}
+	dog := Trigger{Kind: SearchTrigger, Name: "dog"}
+	addTrigger := func(trigger Trigger) func(n *Notification) {
+		return func(n *Notification) {
+			n.Triggers = append(n.Triggers, trigger)
+		}
+	}
+	tests := []struct {
+		name string
+		// claim claims the notification before merging
+		claim        bool
+		userID       TelegramID
+		submissionID int64
+		merges       []Trigger
+		wantFound    bool
+		want         []Trigger
+	}{
+		{"one trigger", false, 1, 100, []Trigger{fox}, true, []Trigger{cat, fox}},
+		{"several triggers", false, 1, 100, []Trigger{fox, dog}, true, []Trigger{cat, fox, dog}},
+		{"other user", false, 2, 100, []Trigger{fox}, false, []Trigger{cat}},
+		{"other submission", false, 1, 101, []Trigger{fox}, false, []Trigger{cat}},
+		{"claimed", true, 1, 100, []Trigger{fox}, false, []Trigger{cat}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := testDB(t)
+			n := &Notification{
+				UserID:       1,
+				SubmissionID: 100,
+				Triggers:     []Trigger{cat},
+				Photo:        []byte("photo"),
+			}
+			err := d.QueueNotification(n)
+			if err != nil {
+				t.Fatalf("Unable to queue notification: %v", err)
+			}
+			if test.claim {
+				_, err = d.ClaimNotification(n.ID)
+				if err != nil {
+					t.Fatalf("Unable to claim notification: %v", err)
+				}
+			}
+
+			for _, trigger := range test.merges {
+				found, err := d.MergeNotification(test.userID, test.submissionID, addTrigger(trigger))
+				if err != nil {
+					t.Fatalf("Unable to merge notification: %v", err)
+				}
+				if found != test.wantFound {
+					t.Errorf("merging %v found = %t, want %t", trigger, found, test.wantFound)
+				}
+			}
+
+			got, err := d.ClaimNotification(n.ID)
+			if err != nil || got == nil {
+				t.Fatalf("Unable to load notification: %v", err)
+			}
+			if len(got.Triggers) != len(test.want) {
+				t.Fatalf("notification has triggers %v, want %v", got.Triggers, test.want)
+			}
+			for i := range got.Triggers {
+				if got.Triggers[i] != test.want[i] {
+					t.Errorf("notification has triggers %v, want %v", got.Triggers, test.want)
+					break
+				}
+			}
+			// merging loads the notification without its photo, which mustn't lose it
+			if string(got.Photo) != "photo" {
+				t.Errorf("notification photo is %q, want %q", got.Photo, "photo")
+			}
+		})
+	}
+}
+
+func TestMergeNotificationAfterSaving(t *testing.T) {
+	d := testDB(t)
+	n := &Notification{
+		UserID:       1,
+		SubmissionID: 100,
+		NextAttempt:  time.Now(),
+	}
+	err := d.QueueNotification(n)
+	if err != nil {
+		t.Fatalf("Unable to queue notification: %v", err)
+	}
+	claimed, err := d.ClaimNotification(n.ID)
+	if err != nil {
+		t.Fatalf("Unable to claim notification: %v", err)
+	}
+
+	// sending it failed, so it goes back in the outbox and can be merged into again
+	claimed.Attempts++
+	err = d.SaveNotification(claimed)
+	if err != nil {
+		t.Fatalf("Unable to save notification: %v", err)
+	}
+	found, err := d.MergeNotification(1, 100, func(n *Notification) {})
+	if err != nil || !found {
+		t.Errorf("MergeNotification after saving = %t, %v, want true", found, err)
+	}
+}
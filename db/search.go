@@ -39,12 +39,13 @@ import (
 
 type (
 	Search struct {
-		// Set during iteration to allow the search to be saved.
-		tx      *bolt.Tx
+		// Set when loaded for polling to allow the search's progress to be saved.
+		d       *db
 		Search  string              `json:"search"`
 		LastRun time.Time           `json:"last_run"`
 		LastID  int64               `json:"last_id"`
 		Users   map[TelegramID]bool `json:"tg_users"`
+		FailureState
 	}
 )
 
@@ -54,41 +55,215 @@ var (
 
 func (d *db) AddSearchForUser(userID TelegramID, search string) error {
 	return d.b.Update(func(tx *bolt.Tx) error {
-		// Add the user to the search, creating it if needed.
-		so, err := getSearch(search, tx)
-		if err != nil {
-			return err
-		}
+		return addSearchForUser(userID, search, tx)
+	})
+}
 
-		if so == nil {
-			so = &Search{
-				Search:  search,
-				LastRun: time.Unix(0, 0),
-				LastID:  0,
-				Users:   map[TelegramID]bool{},
-			}
+func addSearchForUser(userID TelegramID, search string, tx *bolt.Tx) error {
+	// Add the user to the search, creating it if needed.
+	so, err := getSearch(search, tx)
+	if err != nil {
+		return err
+	}
+
+	if so == nil {
+		so = &Search{
+			Search:  search,
+			LastRun: time.Unix(0, 0),
+			LastID:  0,
+			Users:   map[TelegramID]bool{},
 		}
+	}
 
-		so.Users[userID] = true
-		err = saveSearch(so, tx)
+	so.Users[userID] = true
+	err = saveSearch(so, tx)
+	if err != nil {
+		return err
+	}
+
+	// Add the search to the user.
+	user, err := getTGUser(userID, tx)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrNoTGUser
+	}
+	if user.Searches == nil {
+		user.Searches = make(map[string]bool)
+	}
+	user.Searches[search] = true
+	return saveTGUser(user, tx)
+}
+
+// EditSearchForUser changes one of the user's searches to a different search, keeping its settings. If nobody else
+// already has the new search, it starts from where the old one left off, so that nothing posted since the old one last
+// ran is missed.
+func (d *db) EditSearchForUser(userID TelegramID, from, to string) error {
+	return d.b.Update(func(tx *bolt.Tx) error {
+		return editSearchForUser(userID, from, to, tx)
+	})
+}
+
+func editSearchForUser(userID TelegramID, from, to string, tx *bolt.Tx) error {
+	old, err := getSearch(from, tx)
+	if err != nil {
+		return err
+	}
+	if old == nil || !old.Users[userID] {
+		return ErrNoSearch
+	}
+	if from == to {
+		return nil
+	}
+	existing, err := getSearch(to, tx)
+	if err != nil {
+		return err
+	}
+	user, err := getTGUser(userID, tx)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrNoTGUser
+	}
+	settings := user.SearchSettings[from]
+
+	err = deleteSearchForUser(userID, from, tx)
+	if err != nil {
+		return err
+	}
+	err = addSearchForUser(userID, to, tx)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		s, err := getSearch(to, tx)
 		if err != nil {
 			return err
 		}
-
-		// Add the search to the user.
-		user, err := getTGUser(userID, tx)
+		s.LastID = old.LastID
+		s.LastRun = old.LastRun
+		err = saveSearch(s, tx)
 		if err != nil {
 			return err
 		}
-		if user == nil {
-			return ErrNoTGUser
+	}
+
+	if settings == nil {
+		return nil
+	}
+	// the delete and add saved their own changes to the user
+	user, err = getTGUser(userID, tx)
+	if err != nil {
+		return err
+	}
+	if user.SearchSettings == nil {
+		user.SearchSettings = make(map[string]*SubscriptionSettings)
+	}
+	// if they already had the new search, its settings win
+	if _, exists := user.SearchSettings[to]; !exists {
+		user.SearchSettings[to] = settings
+	}
+	return saveTGUser(user, tx)
+}
+
+// CanonicalizeSearches rewrites every search as what canonical returns for it, all in one transaction. Searches that
+// become the same are combined, and their users keep their settings. Searches that canonical returns an error for are
+// left alone. Inconsistent subscriptions are repaired along the way and passed to repaired with what was wrong:
+// ErrNoTGUser for a user who doesn't exist anymore, who is dropped from the search, or ErrNoSearch for a user missing
+// the search from their list, who gets it back. Returns how many searches had users moved to their rewritten form.
+func (d *db) CanonicalizeSearches(canonical func(search string) (string, error),
+	repaired func(search string, userID TelegramID, problem error)) (int, error) {
+
+	rewritten := 0
+	err := d.b.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(searchesBucket)
+		if b == nil {
+			return errors.New("could not load searches bucket")
+		}
+
+		var searches []*Search
+		err := b.ForEach(func(k, v []byte) error {
+			s := &Search{}
+			err := json.Unmarshal(v, s)
+			if err != nil {
+				return fmt.Errorf("unmarshalling search: %s", err)
+			}
+			searches = append(searches, s)
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		if user.Searches == nil {
-			user.Searches = make(map[string]bool)
+
+		for _, old := range searches {
+			to, err := canonical(old.Search)
+			if err != nil || to == old.Search {
+				continue
+			}
+			existing, err := getSearch(to, tx)
+			if err != nil {
+				return err
+			}
+
+			moved := 0
+			for userID := range old.Users {
+				user, err := getTGUser(userID, tx)
+				if err != nil {
+					return err
+				}
+				if user == nil {
+					// there's nobody to move, so they're just dropped from the search
+					err = deleteSearchForUser(userID, old.Search, tx)
+					if err != nil && err != ErrNoTGUser {
+						return err
+					}
+					repaired(old.Search, userID, ErrNoTGUser)
+					continue
+				}
+				if !user.Searches[old.Search] {
+					// the search has been sending them alerts, so their list is made to match it
+					if user.Searches == nil {
+						user.Searches = make(map[string]bool)
+					}
+					user.Searches[old.Search] = true
+					err = saveTGUser(user, tx)
+					if err != nil {
+						return err
+					}
+					repaired(old.Search, userID, ErrNoSearch)
+				}
+
+				err = editSearchForUser(userID, old.Search, to, tx)
+				if err != nil {
+					return err
+				}
+				moved++
+			}
+			if moved == 0 {
+				continue
+			}
+
+			// start from whichever was further behind, so that nobody misses anything. anything the others already
+			// got won't be sent to them again
+			if existing != nil && old.LastID != 0 && old.LastID < existing.LastID {
+				s, err := getSearch(to, tx)
+				if err != nil {
+					return err
+				}
+				s.LastID = old.LastID
+				err = saveSearch(s, tx)
+				if err != nil {
+					return err
+				}
+			}
+			rewritten++
 		}
-		user.Searches[search] = true
-		return saveTGUser(user, tx)
+		return nil
 	})
+	return rewritten, err
 }
 
 // getSearch is a helper func to load a search from the DB for a given search string.
@@ -127,87 +302,119 @@ func saveSearch(search *Search, tx *bolt.Tx) error {
 
 func (d *db) DeleteSearchForUser(userID TelegramID, search string) error {
 	return d.b.Update(func(tx *bolt.Tx) error {
-		// Delete the user from the search.
-		so, err := getSearch(search, tx)
-		if err != nil {
-			return err
-		}
-		if so == nil {
-			return ErrNoSearch
-		}
-		existed := so.Users[userID]
+		return deleteSearchForUser(userID, search, tx)
+	})
+}
 
-		delete(so.Users, userID)
-		if len(so.Users) == 0 {
-			b := tx.Bucket(searchesBucket)
-			if b == nil {
-				return errors.New("could not load searches bucket")
-			}
-			err = b.Delete([]byte(search))
-		} else {
-			err = saveSearch(so, tx)
-		}
-		if err != nil {
-			return err
-		}
+func deleteSearchForUser(userID TelegramID, search string, tx *bolt.Tx) error {
+	// Delete the user from the search.
+	so, err := getSearch(search, tx)
+	if err != nil {
+		return err
+	}
+	if so == nil {
+		return ErrNoSearch
+	}
+	existed := so.Users[userID]
 
-		// Delete the search from the user.
-		user, err := getTGUser(userID, tx)
-		if err != nil {
-			return err
-		}
-		if user == nil {
-			return ErrNoTGUser
-		}
-		if user.Searches == nil {
-			user.Searches = make(map[string]bool)
-		}
-		existed = existed && user.Searches[search]
-		delete(user.Searches, search)
-		err = saveTGUser(user, tx)
-		if err != nil {
-			return err
+	delete(so.Users, userID)
+	if len(so.Users) == 0 {
+		b := tx.Bucket(searchesBucket)
+		if b == nil {
+			return errors.New("could not load searches bucket")
 		}
+		err = b.Delete([]byte(search))
+	} else {
+		err = saveSearch(so, tx)
+	}
+	if err != nil {
+		return err
+	}
 
-		if !existed {
-			return ErrNoSearch
-		}
-		return nil
-	})
+	// Delete the search from the user.
+	user, err := getTGUser(userID, tx)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrNoTGUser
+	}
+	if user.Searches == nil {
+		user.Searches = make(map[string]bool)
+	}
+	existed = existed && user.Searches[search]
+	delete(user.Searches, search)
+	delete(user.SearchSettings, search)
+	err = saveTGUser(user, tx)
+	if err != nil {
+		return err
+	}
+
+	if !existed {
+		return ErrNoSearch
+	}
+	return nil
 }
 
-// Update saves the current state of the search back to the database, if the search was loaded via iteration.
-// Otherwise, ErrCannotSaveNonIteration is returned.
+// Update saves the polling progress of the search (LastRun, LastID, and FailureState) back to the database, if the search was loaded
+// with GetSearch. Otherwise, ErrCannotSaveNonIteration is returned.
+// Everything else is left as it currently is in the database, since users may have been added or removed while the
+// search was running. If the search was deleted while it was running, ErrNoSearch is returned and nothing is saved.
 func (s *Search) Update() error {
-	if s.tx == nil {
+	if s.d == nil {
 		return ErrCannotSaveNonIteration
 	}
 
-	return saveSearch(s, s.tx)
+	return s.d.b.Update(func(tx *bolt.Tx) error {
+		current, err := getSearch(s.Search, tx)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return ErrNoSearch
+		}
+
+		current.LastRun = s.LastRun
+		current.LastID = s.LastID
+		current.FailureState = s.FailureState
+		return saveSearch(current, tx)
+	})
 }
 
-func (d *db) IterateSearches(cb SearchIterator) error {
-	return d.b.Update(func(tx *bolt.Tx) error {
+// GetSearches loads every search. The returned searches were not loaded via iteration, so they cannot be saved with
+// Update.
+func (d *db) GetSearches() ([]*Search, error) {
+	var searches []*Search
+	err := d.b.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(searchesBucket)
 		if b == nil {
 			return errors.New("could not load searches bucket")
 		}
 
-		ul := func(id TelegramID) (*TGUser, error) {
-			return getTGUser(id, tx)
-		}
-
 		return b.ForEach(func(k, v []byte) error {
 			s := &Search{}
 			err := json.Unmarshal(v, s)
 			if err != nil {
 				return fmt.Errorf("unmarshalling search: %s", err)
 			}
-			s.tx = tx
-
-			// TODO maybe we shouldn't immediately return the error from the callback?
-			// If it's a transient FA error, we probably should keep trying the rest.
-			return cb(s, ul)
+			searches = append(searches, s)
+			return nil
 		})
 	})
+	return searches, err
+}
+
+// GetSearch loads a single search without holding a transaction open, so that it can be polled. Its progress can be
+// saved afterwards with Update. Returns nil if the search does not exist.
+func (d *db) GetSearch(search string) (*Search, error) {
+	var s *Search
+	err := d.b.View(func(tx *bolt.Tx) error {
+		var err error
+		s, err = getSearch(search, tx)
+		return err
+	})
+	if s != nil {
+		s.d = d
+	}
+	return s, err
 }
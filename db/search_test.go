@@ -0,0 +1,155 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package db
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/etcd-io/bbolt"
+)
+
+// sortWords stands in for the bot's canonical form of a search.
+func sortWords(search string) (string, error) {
+	words := strings.Fields(strings.ToLower(search))
+	sort.Strings(words)
+	return strings.Join(words, " "), nil
+}
+
+func TestCanonicalizeSearches(t *testing.T) {
+	d := testDB(t)
+	for _, id := range []TelegramID{1, 2} {
+		err := d.SaveTGUser(&TGUser{ID: id})
+		if err != nil {
+			t.Fatalf("Unable to save user: %v", err)
+		}
+	}
+	for _, sub := range []struct {
+		userID TelegramID
+		search string
+	}{
+		{1, "Dog Cat"},
+		{2, "Dog Cat"},
+		{2, "cat dog"},
+		{1, "wolf"},
+	} {
+		err := d.AddSearchForUser(sub.userID, sub.search)
+		if err != nil {
+			t.Fatalf("Unable to add search: %v", err)
+		}
+	}
+
+	// break the subscriptions the ways they could have been left by older versions
+	err := d.(*db).b.Update(func(tx *bolt.Tx) error {
+		// a search listing a user who doesn't exist anymore, with someone real
+		s, err := getSearch("Dog Cat", tx)
+		if err != nil {
+			return err
+		}
+		s.Users[3] = true
+		err = saveSearch(s, tx)
+		if err != nil {
+			return err
+		}
+		// a search only for users who don't exist anymore
+		err = saveSearch(&Search{Search: "Fox", Users: map[TelegramID]bool{4: true}}, tx)
+		if err != nil {
+			return err
+		}
+		// a search that a user is missing from their list
+		user, err := getTGUser(1, tx)
+		if err != nil {
+			return err
+		}
+		delete(user.Searches, "Dog Cat")
+		return saveTGUser(user, tx)
+	})
+	if err != nil {
+		t.Fatalf("Unable to break subscriptions: %v", err)
+	}
+
+	repairs := make(map[TelegramID]error)
+	rewritten, err := d.CanonicalizeSearches(sortWords, func(search string, userID TelegramID, problem error) {
+		repairs[userID] = problem
+	})
+	if err != nil {
+		t.Fatalf("CanonicalizeSearches failed: %v", err)
+	}
+
+	if rewritten != 1 {
+		t.Errorf("rewrote %d searches, want 1", rewritten)
+	}
+	wantRepairs := map[TelegramID]error{1: ErrNoSearch, 3: ErrNoTGUser, 4: ErrNoTGUser}
+	if len(repairs) != len(wantRepairs) {
+		t.Errorf("repaired %v, want %v", repairs, wantRepairs)
+	}
+	for userID, problem := range wantRepairs {
+		if repairs[userID] != problem {
+			t.Errorf("user %d repaired for %v, want %v", userID, repairs[userID], problem)
+		}
+	}
+
+	searches, err := d.GetSearches()
+	if err != nil {
+		t.Fatalf("Unable to load searches: %v", err)
+	}
+	got := make(map[string]map[TelegramID]bool)
+	for _, s := range searches {
+		got[s.Search] = s.Users
+	}
+	want := map[string]map[TelegramID]bool{
+		"cat dog": {1: true, 2: true},
+		"wolf":    {1: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("searches are %v, want %v", got, want)
+	}
+	for search, users := range want {
+		if len(got[search]) != len(users) {
+			t.Errorf("search %q has users %v, want %v", search, got[search], users)
+			continue
+		}
+		for userID := range users {
+			if !got[search][userID] {
+				t.Errorf("search %q has users %v, want %v", search, got[search], users)
+			}
+		}
+	}
+
+	for _, id := range []TelegramID{1, 2} {
+		user, err := d.GetTGUser(id)
+		if err != nil || user == nil {
+			t.Fatalf("Unable to load user %d: %v", id, err)
+		}
+		if !user.Searches["cat dog"] || user.Searches["Dog Cat"] {
+			t.Errorf("user %d has searches %v, want cat dog", id, user.Searches)
+		}
+	}
+}
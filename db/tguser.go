@@ -32,6 +32,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/etcd-io/bbolt"
@@ -47,9 +48,194 @@ type (
 		Searches        map[string]bool `json:"searches"`
 		SubmissionUsers map[string]bool `json:"submission_users"`
 		JournalUsers    map[string]bool `json:"journal_users"`
+
+		// The settings maps are keyed the same way as the subscriptions they belong to. Subscriptions without any
+		// settings aren't in them.
+		SearchSettings         map[string]*SubscriptionSettings `json:"search_settings,omitempty"`
+		SubmissionUserSettings map[string]*SubscriptionSettings `json:"submission_user_settings,omitempty"`
+		JournalUserSettings    map[string]*SubscriptionSettings `json:"journal_user_settings,omitempty"`
+
+		// SnoozedUntil silences all of the user's alerts until then. If SnoozeHold is set, the alerts are held and sent
+		// when the snooze ends, instead of being skipped.
+		SnoozedUntil time.Time `json:"snoozed_until,omitempty"`
+		SnoozeHold   bool      `json:"snooze_hold,omitempty"`
+
+		// Timezone is the name of the user's IANA time zone, like "Europe/Berlin". Empty means UTC.
+		Timezone   string      `json:"timezone,omitempty"`
+		QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+
+		DeliveryMode DeliveryMode `json:"delivery_mode,omitempty"`
+		// DigestHour is the hour of the day, in the user's time zone, that daily digests are sent.
+		DigestHour int `json:"digest_hour,omitempty"`
+
+		// BlockedArtists are never alerted about, however they were found. They are lower case.
+		BlockedArtists map[string]bool `json:"blocked_artists,omitempty"`
+	}
+
+	// QuietHours is a window of time each day, in the user's time zone, when alerts are held and sent once it ends.
+	// The window may wrap around midnight.
+	QuietHours struct {
+		// Start and End are minutes after midnight.
+		Start int `json:"start"`
+		End   int `json:"end"`
+		// Summary collapses held alerts into a single summary when they are sent, whether they were held for quiet
+		// hours or a snooze.
+		Summary bool `json:"summary,omitempty"`
+	}
+
+	// Subscriptions is all of a telegram user's subscriptions with their settings, keyed the same way as TGUser's
+	// subscriptions. Subscriptions without settings have empty settings, rather than nil.
+	Subscriptions struct {
+		Searches        map[string]*SubscriptionSettings `json:"searches"`
+		SubmissionUsers map[string]*SubscriptionSettings `json:"submission_users"`
+		JournalUsers    map[string]*SubscriptionSettings `json:"journal_users"`
+		// DisplayNames are the names furaffinity users like to be written as, where we know them. They are keyed by
+		// the lower case name.
+		DisplayNames map[string]string `json:"-"`
+	}
+
+	// SubscriptionSettings are a telegram user's settings for one of their subscriptions.
+	SubscriptionSettings struct {
+		// Paused subscriptions don't send any alerts. What would have been sent while paused is not sent later.
+		Paused bool `json:"paused,omitempty"`
+		// Ratings are the only ratings of submission that are sent. Empty allows every rating.
+		Ratings []string `json:"ratings,omitempty"`
+		// Exclude drops submissions with any of these words in their title or artist's name. They are lower case.
+		Exclude []string `json:"exclude,omitempty"`
+		// Rules are regular expressions that submissions must all match, written as "field:regexp", where field is
+		// title, artist or rating.
+		Rules []string `json:"rules,omitempty"`
 	}
 )
 
+// Blocked returns whether the user blocked the artist, ignoring case.
+func (u *TGUser) Blocked(artist string) bool {
+	return u.BlockedArtists[strings.ToLower(artist)]
+}
+
+// Snoozed returns whether the user's alerts are snoozed at the given time.
+func (u *TGUser) Snoozed(now time.Time) bool {
+	return now.Before(u.SnoozedUntil)
+}
+
+// Location loads the user's time zone, falling back to UTC if they haven't set one or it can't be loaded.
+func (u *TGUser) Location() *time.Location {
+	if u.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Subscriptions collects the user's subscriptions with their settings.
+func (u *TGUser) Subscriptions() *Subscriptions {
+	return &Subscriptions{
+		Searches:        withSettings(u.Searches, u.SearchSettings),
+		SubmissionUsers: withSettings(u.SubmissionUsers, u.SubmissionUserSettings),
+		JournalUsers:    withSettings(u.JournalUsers, u.JournalUserSettings),
+	}
+}
+
+func withSettings(keys map[string]bool, settings map[string]*SubscriptionSettings) map[string]*SubscriptionSettings {
+	m := make(map[string]*SubscriptionSettings, len(keys))
+	for k := range keys {
+		s := settings[k]
+		if s == nil {
+			s = &SubscriptionSettings{}
+		}
+		m[k] = s
+	}
+	return m
+}
+
+// SetSubscriptions changes the user's subscriptions to match subs, all in one transaction so that nothing is changed
+// if any of it fails. The settings of subscriptions in subs replace any the user had. If replace is false, the user's
+// subscriptions that aren't in subs are kept, otherwise they are deleted. The furaffinity users in subs must be lower
+// case, like they are everywhere else.
+func (d *db) SetSubscriptions(userID TelegramID, subs *Subscriptions, replace bool) error {
+	return d.b.Update(func(tx *bolt.Tx) error {
+		user, err := getTGUser(userID, tx)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return ErrNoTGUser
+		}
+
+		if replace {
+			for search := range user.Searches {
+				if _, keep := subs.Searches[search]; !keep {
+					err = deleteSearchForUser(userID, search, tx)
+					if err != nil && err != ErrNoSearch {
+						return err
+					}
+				}
+			}
+			for faUser := range user.SubmissionUsers {
+				if _, keep := subs.SubmissionUsers[faUser]; !keep {
+					err = deleteUserSubmissionsForUser(userID, faUser, tx)
+					if err != nil && err != ErrNoFAUser {
+						return err
+					}
+				}
+			}
+			for faUser := range user.JournalUsers {
+				if _, keep := subs.JournalUsers[faUser]; !keep {
+					err = deleteUserJournalsForUser(userID, faUser, tx)
+					if err != nil && err != ErrNoFAUser {
+						return err
+					}
+				}
+			}
+		}
+
+		for search := range subs.Searches {
+			err = addSearchForUser(userID, search, tx)
+			if err != nil {
+				return err
+			}
+		}
+		for faUser := range subs.SubmissionUsers {
+			err = addUserSubmissionsForUser(userID, faUser, subs.DisplayNames[faUser], tx)
+			if err != nil {
+				return err
+			}
+		}
+		for faUser := range subs.JournalUsers {
+			err = addUserJournalsForUser(userID, faUser, subs.DisplayNames[faUser], tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the adds and deletes saved their own changes to the user
+		user, err = getTGUser(userID, tx)
+		if err != nil {
+			return err
+		}
+		setSettings(&user.SearchSettings, subs.Searches)
+		setSettings(&user.SubmissionUserSettings, subs.SubmissionUsers)
+		setSettings(&user.JournalUserSettings, subs.JournalUsers)
+		return saveTGUser(user, tx)
+	})
+}
+
+func setSettings(m *map[string]*SubscriptionSettings, settings map[string]*SubscriptionSettings) {
+	for k, s := range settings {
+		if s == nil {
+			delete(*m, k)
+			continue
+		}
+		if *m == nil {
+			*m = make(map[string]*SubscriptionSettings)
+		}
+		(*m)[k] = s
+	}
+}
+
 // GetTGUser loads the user with the given ID, if the user exists. If the user
 // does not exist, nil is returned.
 func (d *db) GetTGUser(id TelegramID) (*TGUser, error) {
@@ -82,6 +268,26 @@ func getTGUser(id TelegramID, tx *bolt.Tx) (*TGUser, error) {
 	return user, nil
 }
 
+// UpdateTGUser loads the user with the given ID, calls f to change it, and saves it, all in one transaction. If f
+// returns an error, nothing is saved. If the user does not exist, ErrNoTGUser is returned.
+func (d *db) UpdateTGUser(id TelegramID, f func(user *TGUser) error) error {
+	return d.b.Update(func(tx *bolt.Tx) error {
+		user, err := getTGUser(id, tx)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return ErrNoTGUser
+		}
+
+		err = f(user)
+		if err != nil {
+			return err
+		}
+		return saveTGUser(user, tx)
+	})
+}
+
 // SaveTGUser saves the given user in the database, overwriting any old information about the user.
 func (d *db) SaveTGUser(user *TGUser) error {
 	return d.b.Update(func(tx *bolt.Tx) error {
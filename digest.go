@@ -0,0 +1,304 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajanata/faapi"
+	"github.com/ajanata/fanotify/db"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// digestCheckInterval is how often pending digests are checked to see if they are due.
+	digestCheckInterval = time.Minute
+	defaultDigestHour   = 9
+	// Telegram albums can have 2 to 10 photos.
+	maxAlbumSize = 10
+
+	digestContinuedHeader = "<b>Your digest, continued.</b>"
+
+	digestUsageMsg = `Send <code>/digest hourly</code> or <code>/digest daily</code> to get your alerts together in a digest instead of as they are found. Daily digests are sent at 9:00 in your /quiethours time zone, or add the hour you want, like <code>/digest daily 18</code>.
+
+Send <code>/digest off</code> to get alerts as they are found again.`
+)
+
+// digestDue is when the digest an alert found now should be in is due for the user.
+func digestDue(user *db.TGUser, now time.Time) time.Time {
+	// snoozes and quiet hours hold digests too
+	at := releaseTime(user, now)
+
+	var due time.Time
+	switch user.DeliveryMode {
+	case db.DeliverDaily:
+		lt := at.In(user.Location())
+		due = time.Date(lt.Year(), lt.Month(), lt.Day(), user.DigestHour, 0, 0, 0, lt.Location())
+		if !due.After(at) {
+			due = time.Date(lt.Year(), lt.Month(), lt.Day()+1, user.DigestHour, 0, 0, 0, lt.Location())
+		}
+	default:
+		due = at.Truncate(time.Hour).Add(time.Hour)
+	}
+
+	if end, quiet := quietHoursEnd(user, due); quiet {
+		due = end
+	}
+	return due
+}
+
+// deliverAlert sends an alert the way the user wants it. n is the notification to send them, and item is what goes in
+// their digest if they get one instead.
+func (b *bot) deliverAlert(userID int, fb *tgbotapi.FileBytes, n db.Notification, item db.DigestItem,
+	d delivery) {
+
+	if d.digestDue.IsZero() {
+		b.queueAlert(userID, fb, n, d)
+		return
+	}
+
+	item.UserID = db.TelegramID(userID)
+	item.Due = d.digestDue
+	err := b.db.AddDigestItem(&item)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":   "deliverAlert",
+			"userID": userID,
+		}).Error("Unable to add alert to digest, sending it now")
+		b.queueAlert(userID, fb, n, delivery{})
+	}
+}
+
+// submissionDigestItem makes the digest item for a submission.
+func submissionDigestItem(trigger string, sub *faapi.Submission) db.DigestItem {
+	photo := sub.PreviewURL
+	// FA uses protocol-relative URLs, which Telegram can't fetch
+	if strings.HasPrefix(photo, "//") {
+		photo = "https:" + photo
+	}
+	return db.DigestItem{
+		Trigger:      trigger,
+		SubmissionID: sub.ID,
+		Title:        sub.Title,
+		User:         sub.User,
+		Rating:       string(sub.Rating),
+		Link:         fmt.Sprintf("https://www.furaffinity.net/view/%d/", sub.ID),
+		PhotoURL:     photo,
+	}
+}
+
+// digestSender moves digests into the outbox when they are due.
+func (b *bot) digestSender() {
+	defer logPanic()
+	defer b.backgroundJobs.Done()
+
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.shouldQuit:
+			log.Info("stopping digest sender")
+			return
+		case <-ticker.C:
+			flushed, err := b.db.FlushDigests(time.Now(), buildDigest)
+			if err != nil {
+				log.WithError(err).Error("Unable to send digests")
+			} else if flushed > 0 {
+				log.WithField("users", flushed).Debug("Sent digests")
+				b.wakeSender()
+			}
+		}
+	}
+}
+
+// buildDigest makes albums of the photos in the user's digest, followed by an index of everything in it grouped by the
+// trigger that found it. The numbers in the album captions match the index. A group too long for one message is split
+// between its lines, with the trigger repeated at the top of each message it continues into.
+func buildDigest(userID db.TelegramID, items []*db.DigestItem) []*db.Notification {
+	var triggers []string
+	byTrigger := make(map[string][]*db.DigestItem)
+	for _, item := range items {
+		if _, exists := byTrigger[item.Trigger]; !exists {
+			triggers = append(triggers, item.Trigger)
+		}
+		byTrigger[item.Trigger] = append(byTrigger[item.Trigger], item)
+	}
+
+	var albums []*db.Notification
+	var album []db.AlbumPhoto
+	index := make([][]string, 0, len(triggers))
+	num := 0
+	for _, trigger := range triggers {
+		var lines []string
+		for _, item := range byTrigger[trigger] {
+			num++
+			line := fmt.Sprintf("%d. <a href=\"%s\">%s</a> by %s (%s)", num, item.Link, escapeHTML(item.Title),
+				escapeHTML(item.User), ratingLabel(faapi.Rating(item.Rating)))
+			lines = append(lines, line)
+
+			if item.PhotoURL == "" {
+				continue
+			}
+			album = append(album, db.AlbumPhoto{
+				URL:     item.PhotoURL,
+				Caption: strconv.Itoa(num) + ". " + escapeHTML(item.Title),
+			})
+			if len(album) == maxAlbumSize {
+				albums = append(albums, &db.Notification{UserID: userID, Album: album})
+				album = nil
+			}
+		}
+		index = append(index, lines)
+	}
+	if len(album) > 0 {
+		albums = append(albums, &db.Notification{UserID: userID, Album: album})
+	}
+
+	header := fmt.Sprintf("<b>Your digest has %d new items.</b>", num)
+	var ns []*db.Notification
+	text := header
+	started := false
+	next := func() {
+		ns = append(ns, &db.Notification{UserID: userID, Text: text})
+		text = digestContinuedHeader
+		started = false
+	}
+	for i, lines := range index {
+		heading := "<b>" + triggers[i] + "</b>"
+		// a group that would fit in a message by itself starts a new one rather than being split
+		group := "\n\n" + heading + "\n" + strings.Join(lines, "\n")
+		fits := len(digestContinuedHeader)+len(group) <= maxSummaryLength
+		if started && fits && len(text)+len(group) > maxSummaryLength {
+			next()
+		}
+		text += "\n\n" + heading
+		started = true
+		for _, line := range lines {
+			if len(text)+len("\n")+len(line) > maxSummaryLength {
+				next()
+				text += "\n\n<b>" + triggers[i] + " (continued)</b>"
+				started = true
+			}
+			text += "\n" + line
+		}
+	}
+	ns = append(ns, &db.Notification{UserID: userID, Text: text})
+	return append(albums, ns...)
+}
+
+// cmdDigest changes how the user gets their alerts.
+func (b *bot) cmdDigest(u *tgbotapi.User, args string) {
+	logger := log.WithFields(log.Fields{
+		"func":     "cmdDigest",
+		"userID":   u.ID,
+		"username": u.UserName,
+		"args":     args,
+	})
+
+	if !b.userStartedBot(u.ID) {
+		return
+	}
+
+	fields := strings.Fields(strings.ToLower(args))
+	if len(fields) == 0 {
+		b.digestStatus(u)
+		return
+	}
+
+	var mode db.DeliveryMode
+	hour := defaultDigestHour
+	switch {
+	case fields[0] == "off" && len(fields) == 1:
+		mode = db.DeliverImmediately
+	case fields[0] == string(db.DeliverHourly) && len(fields) == 1:
+		mode = db.DeliverHourly
+	case fields[0] == string(db.DeliverDaily) && len(fields) <= 2:
+		mode = db.DeliverDaily
+		if len(fields) == 2 {
+			var err error
+			hour, err = strconv.Atoi(fields[1])
+			if err != nil || hour < 0 || hour > 23 {
+				b.sendHTMLMessage(u.ID, "The hour has to be a number from 0 to 23.\n\n%s", digestUsageMsg)
+				return
+			}
+		}
+	default:
+		b.sendHTMLMessage(u.ID, digestUsageMsg)
+		return
+	}
+
+	now := time.Now()
+	due := now
+	err := b.db.UpdateTGUser(db.TelegramID(u.ID), func(user *db.TGUser) error {
+		user.DeliveryMode = mode
+		user.DigestHour = hour
+		if mode != db.DeliverImmediately {
+			due = digestDue(user, now)
+		}
+		return nil
+	})
+	if err == nil {
+		// anything already waiting goes in the next digest, or out right away if they don't want digests anymore
+		err = b.db.RescheduleDigest(db.TelegramID(u.ID), due)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Unable to save delivery mode")
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "digest change"))
+		return
+	}
+
+	b.digestStatus(u)
+}
+
+func (b *bot) digestStatus(u *tgbotapi.User) {
+	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
+	if err != nil || user == nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":   "digestStatus",
+			"userID": u.ID,
+		}).Error("Could not load user")
+		b.sendMessage(u.ID, loadFailedFormat, "your digest settings")
+		return
+	}
+
+	switch user.DeliveryMode {
+	case db.DeliverHourly:
+		b.sendHTMLMessage(u.ID, "You get your alerts in an hourly digest.\n\n%s", digestUsageMsg)
+	case db.DeliverDaily:
+		b.sendHTMLMessage(u.ID, "You get your alerts in a daily digest at %02d:00, %s time.\n\n%s", user.DigestHour,
+			user.Location(), digestUsageMsg)
+	default:
+		b.sendHTMLMessage(u.ID, "You get your alerts as they are found.\n\n%s", digestUsageMsg)
+	}
+}
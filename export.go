@@ -0,0 +1,425 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ajanata/fanotify/db"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	exportVersion  = 1
+	exportFilename = "fanotify-alerts.json"
+	// maxImportSize is far bigger than anyone's alerts should be, it just keeps us from downloading anything huge.
+	maxImportSize   = 1 << 20
+	downloadTimeout = 30 * time.Second
+	// maxImportListed keeps the summary of an import within Telegram's message length limit.
+	maxImportListed = 25
+
+	importMsg = `Send me a file from /export, and I will add everything in it to your alerts. Alerts that are in the file replace their settings with the ones from the file, and anything else you have is kept.
+
+To also delete everything that isn't in the file, send <code>/import replace</code> instead.
+
+Or, you can send /cancel to cancel importing alerts.`
+	importReplaceMsg = `Send me a file from /export, and I will change your alerts to match it exactly. Anything that isn't in the file will be deleted.
+
+Or, you can send /cancel to cancel importing alerts.`
+)
+
+type (
+	// subscriptionsExport is the file users get from /export and give to /import.
+	subscriptionsExport struct {
+		Version int `json:"version"`
+		*db.Subscriptions
+	}
+)
+
+// cmdExport sends the user a file with all of their alerts and their settings, which /import accepts.
+func (b *bot) cmdExport(u *tgbotapi.User) {
+	logger := log.WithFields(log.Fields{
+		"func":     "cmdExport",
+		"userID":   u.ID,
+		"username": u.UserName,
+	})
+
+	if !b.userStartedBot(u.ID) {
+		return
+	}
+
+	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
+	if err != nil || user == nil {
+		logger.WithError(err).Error("Could not load user")
+		b.sendMessage(u.ID, loadFailedFormat, "your saved alerts")
+		return
+	}
+
+	data, err := json.MarshalIndent(subscriptionsExport{
+		Version:       exportVersion,
+		Subscriptions: user.Subscriptions(),
+	}, "", "  ")
+	if err != nil {
+		logger.WithError(err).Error("Unable to marshal export")
+		b.sendMessage(u.ID, loadFailedFormat, "your saved alerts")
+		return
+	}
+
+	m := tgbotapi.NewDocumentUpload(int64(u.ID), tgbotapi.FileBytes{
+		Name:  exportFilename,
+		Bytes: data,
+	})
+	m.Caption = "Here are your alerts. Send /import and then this file to get them back, here or on another bot."
+	b.send(u.ID, m)
+}
+
+// cmdImport asks the user for a file from /export to apply to their alerts.
+func (b *bot) cmdImport(u *tgbotapi.User, args string) {
+	if !b.userStartedBot(u.ID) {
+		return
+	}
+
+	replace := false
+	switch strings.ToLower(args) {
+	case "":
+	case "replace":
+		replace = true
+	default:
+		b.sendHTMLMessage(u.ID, importMsg)
+		return
+	}
+
+	b.plaintextHandler[u.ID] = func(m *tgbotapi.Message) {
+		b.runInBackground(func() { b.importSubscriptions(m, replace) })
+	}
+	if replace {
+		b.sendHTMLMessage(u.ID, importReplaceMsg)
+	} else {
+		b.sendHTMLMessage(u.ID, importMsg)
+	}
+}
+
+// importSubscriptions applies an exported file to the user's alerts. Downloading the file can take a while, so this is
+// run in its own goroutine instead of holding up the update loop.
+func (b *bot) importSubscriptions(m *tgbotapi.Message, replace bool) {
+	defer logPanic()
+	u := m.From
+	logger := log.WithFields(log.Fields{
+		"func":     "importSubscriptions",
+		"userID":   u.ID,
+		"username": u.UserName,
+		"replace":  replace,
+	})
+
+	if m.Document == nil {
+		b.sendMessage(u.ID, "That isn't a file. Please send /import again, and then the file from /export.")
+		return
+	}
+	if m.Document.FileSize > maxImportSize {
+		b.sendMessage(u.ID, "That file is too big to be from /export.")
+		return
+	}
+
+	data, err := b.downloadFile(m.Document.FileID)
+	if err != nil {
+		logger.WithError(err).Warn("Unable to download import")
+		b.sendMessage(u.ID, "Sorry, I couldn't download that file. Please try again later.")
+		return
+	}
+
+	subs, problem := parseExport(data)
+	if problem != "" {
+		b.sendHTMLMessage(u.ID, "I can't import that file: %s", escapeHTML("%s", problem))
+		return
+	}
+
+	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
+	if err != nil || user == nil {
+		logger.WithError(err).Error("Could not load user")
+		b.sendMessage(u.ID, loadFailedFormat, "your saved alerts")
+		return
+	}
+	before := user.Subscriptions()
+
+	if !b.lookupImportedFAUsers(u, subs) {
+		return
+	}
+
+	err = b.db.SetSubscriptions(db.TelegramID(u.ID), subs, replace)
+	if err != nil {
+		logger.WithError(err).Error("Unable to import subscriptions")
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "import"))
+		return
+	}
+
+	logger.Info("Imported subscriptions")
+	b.sendHTMLMessage(u.ID, "%s", b.importSummary(before, subs, replace))
+}
+
+// lookupImportedFAUsers checks that the furaffinity users in an import exist, the same as if they were added by hand,
+// and fills in their names. Users someone is already getting alerts for don't need to be checked again. If any can't
+// be found, the telegram user is told so and ok is false.
+func (b *bot) lookupImportedFAUsers(u *tgbotapi.User, subs *db.Subscriptions) (ok bool) {
+	logger := log.WithFields(log.Fields{
+		"func":   "lookupImportedFAUsers",
+		"userID": u.ID,
+	})
+
+	var unknown []string
+	for _, faUser := range sortedKeys(mergeSettingsKeys(subs.SubmissionUsers, subs.JournalUsers)) {
+		fa, err := b.db.GetFAUser(faUser)
+		if err != nil {
+			logger.WithError(err).WithField("faUser", faUser).Error("Could not load furaffinity user")
+			b.sendMessage(u.ID, loadFailedFormat, "the users in that file")
+			return false
+		}
+		if fa == nil {
+			unknown = append(unknown, faUser)
+		}
+	}
+	if len(unknown) == 0 {
+		return true
+	}
+
+	b.sendMessage(u.ID, "Looking up %d users on FurAffinity...", len(unknown))
+	subs.DisplayNames = make(map[string]string)
+	var missing []string
+	for _, faUser := range unknown {
+		name, found, err := b.findFAUser(faUser)
+		if err != nil {
+			logger.WithError(err).WithField("faUser", faUser).Warn("Unable to look up furaffinity user")
+			b.sendMessage(u.ID, faLookupFailedMsg)
+			return false
+		}
+		if !found {
+			missing = append(missing, fmt.Sprintf("<code>%s</code>", escapeHTML(faUser)))
+			continue
+		}
+		if name != "" {
+			subs.DisplayNames[faUser] = name
+		}
+	}
+
+	if len(missing) > 0 {
+		b.sendHTMLMessage(u.ID, "I can't import that file: I couldn't find these users on FurAffinity.%s",
+			importSummarySection("Missing", missing))
+		return false
+	}
+	return true
+}
+
+// mergeSettingsKeys returns a set of the keys in any of the maps.
+func mergeSettingsKeys(ms ...map[string]*db.SubscriptionSettings) map[string]bool {
+	keys := make(map[string]bool)
+	for _, m := range ms {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+// downloadFile downloads a file someone sent us.
+func (b *bot) downloadFile(fileID string) ([]byte, error) {
+	url, err := b.tg.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{Timeout: downloadTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading file: %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxImportSize))
+}
+
+// parseExport checks an exported file, returning its subscriptions cleaned up the same way they would be if they were
+// added by hand. If there is something wrong with it, problem says what.
+func parseExport(data []byte) (subs *db.Subscriptions, problem string) {
+	export := subscriptionsExport{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&export)
+	if err != nil || export.Version == 0 {
+		return nil, "it isn't a file from /export."
+	}
+	if export.Version != exportVersion || export.Subscriptions == nil {
+		return nil, fmt.Sprintf("it is from a version of the bot I don't understand (%d).", export.Version)
+	}
+
+	subs = &db.Subscriptions{
+		Searches:        make(map[string]*db.SubscriptionSettings),
+		SubmissionUsers: make(map[string]*db.SubscriptionSettings),
+		JournalUsers:    make(map[string]*db.SubscriptionSettings),
+	}
+	for search, settings := range export.Searches {
+		canonical, err := canonicalSearch(search)
+		if err != nil {
+			return nil, fmt.Sprintf("%q isn't a search I can use, because %s.", search, err)
+		}
+		search = canonical
+		settings, problem = checkImportedSettings(settings)
+		if problem != "" {
+			return nil, problem
+		}
+		subs.Searches[search] = settings
+	}
+	for _, users := range []struct {
+		from, to map[string]*db.SubscriptionSettings
+	}{
+		{export.SubmissionUsers, subs.SubmissionUsers},
+		{export.JournalUsers, subs.JournalUsers},
+	} {
+		for faUser, settings := range users.from {
+			faUser = strings.ToLower(strings.TrimSpace(faUser))
+			if !faUsernameRegexp.MatchString(faUser) {
+				return nil, fmt.Sprintf("%q isn't a FurAffinity username.", faUser)
+			}
+			settings, problem = checkImportedSettings(settings)
+			if problem != "" {
+				return nil, problem
+			}
+			users.to[faUser] = settings
+		}
+	}
+	return subs, ""
+}
+
+// checkImportedSettings cleans up a subscription's imported settings the same way they would have been saved if they
+// were set by hand. If there is something wrong with them, problem says what.
+func checkImportedSettings(s *db.SubscriptionSettings) (cleaned *db.SubscriptionSettings, problem string) {
+	if s == nil {
+		return &db.SubscriptionSettings{}, ""
+	}
+
+	ratings, err := checkRatings(s.Ratings)
+	if err != nil {
+		return nil, fmt.Sprintf("it has ratings I don't understand (%s).", err)
+	}
+	s.Ratings = ratings
+
+	exclude, rules, problem := checkImportedFilters(s.Exclude, s.Rules)
+	if problem != "" {
+		return nil, "it has filters I can't use. " + problem
+	}
+	s.Exclude, s.Rules = exclude, rules
+	return s, ""
+}
+
+// importSummary describes what an import changed.
+func (b *bot) importSummary(before, after *db.Subscriptions, replace bool) string {
+	var added, removed, changed []string
+	unchanged := 0
+	for _, kind := range []struct {
+		before, after map[string]*db.SubscriptionSettings
+		format        string
+		users         bool
+	}{
+		{before.Searches, after.Searches, "Search <code>%s</code>", false},
+		{before.SubmissionUsers, after.SubmissionUsers, "Submissions from <code>%s</code>", true},
+		{before.JournalUsers, after.JournalUsers, "Journals from <code>%s</code>", true},
+	} {
+		label := func(key string) string {
+			if kind.users {
+				key = b.faUserName(key)
+			}
+			return fmt.Sprintf(kind.format, escapeHTML(key))
+		}
+
+		for _, key := range sortedSettingsKeys(kind.after) {
+			old, existed := kind.before[key]
+			switch {
+			case !existed:
+				added = append(added, label(key))
+			case !reflect.DeepEqual(old, kind.after[key]):
+				changed = append(changed, label(key))
+			default:
+				unchanged++
+			}
+		}
+		if !replace {
+			continue
+		}
+		for _, key := range sortedSettingsKeys(kind.before) {
+			if _, kept := kind.after[key]; !kept {
+				removed = append(removed, label(key))
+			}
+		}
+	}
+
+	if len(added) == 0 && len(removed) == 0 && len(changed) == 0 {
+		return "Everything in that file was already set up the same way."
+	}
+
+	msg := "Imported your alerts."
+	msg += importSummarySection("Added", added)
+	msg += importSummarySection("Deleted", removed)
+	msg += importSummarySection("Changed settings for", changed)
+	if unchanged > 0 {
+		msg += fmt.Sprintf("\n\n%d already matched the file.", unchanged)
+	}
+	return msg
+}
+
+func importSummarySection(title string, items []string) string {
+	if len(items) == 0 {
+		return ""
+	}
+
+	s := fmt.Sprintf("\n\n<b>%s %d:</b>", title, len(items))
+	for i, item := range items {
+		if i == maxImportListed {
+			s += fmt.Sprintf("\n...and %d more", len(items)-i)
+			break
+		}
+		s += "\n" + item
+	}
+	return s
+}
+
+func sortedSettingsKeys(m map[string]*db.SubscriptionSettings) []string {
+	set := make(map[string]bool, len(m))
+	for k := range m {
+		set[k] = true
+	}
+	return sortedKeys(set)
+}
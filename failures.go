@@ -0,0 +1,97 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/ajanata/fanotify/db"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxBackoff            = time.Hour
+	defaultFailureAlertThreshold = 5
+)
+
+// updateFailureState records the outcome of polling a search or furaffinity user. Each consecutive failure doubles how
+// long until the item is retried, up to the configured maximum, and the owner is alerted once the item has failed more
+// times in a row than the configured threshold.
+func (b *bot) updateFailureState(fs *db.FailureState, err error, logger *log.Entry) {
+	if err == nil {
+		if fs.OwnerAlerted {
+			logger.WithField("failures", fs.ConsecutiveFailures).Warn("Recovered after repeated failures")
+		}
+		fs.ConsecutiveFailures = 0
+		fs.LastError = ""
+		fs.NextRetry = time.Time{}
+		fs.OwnerAlerted = false
+		return
+	}
+
+	fs.ConsecutiveFailures++
+	fs.LastError = err.Error()
+	fs.LastFailure = time.Now()
+	fs.NextRetry = fs.LastFailure.Add(b.backoff(fs.ConsecutiveFailures))
+
+	logger = logger.WithError(err).WithFields(log.Fields{
+		"failures":   fs.ConsecutiveFailures,
+		"next_retry": fs.NextRetry,
+	})
+
+	threshold := b.c.FA.FailureAlertThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureAlertThreshold
+	}
+	if fs.ConsecutiveFailures >= threshold && !fs.OwnerAlerted {
+		// this goes to the owner via the Telegram log hook
+		logger.Error("Repeatedly failing, backing off")
+		fs.OwnerAlerted = true
+	} else {
+		logger.Info("Failed, backing off")
+	}
+}
+
+// backoff is how long to wait before retrying after the given number of consecutive failures. The first retry happens
+// after the normal poll interval.
+func (b *bot) backoff(failures int) time.Duration {
+	max := b.c.FA.MaxBackoff.convert()
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	d := b.c.FA.PollInterval.convert()
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
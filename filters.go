@@ -0,0 +1,532 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ajanata/faapi"
+	"github.com/ajanata/fanotify/db"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// callbackRatings shows the rating buttons for a subscription, and callbackToggleRating followed by the first
+	// letter of a rating turns that rating on or off.
+	callbackRatings      = "r"
+	callbackToggleRating = "t"
+
+	ratingsPrompt = "\n\nTap below to choose which ratings you want alerts for. FurAffinity doesn't always say what " +
+		"a submission is rated, and those are only sent if you want every rating."
+
+	// these keep anyone from making every result slow to check
+	maxFilterRules  = 10
+	maxFilterLength = 200
+	// maxCompiledRules is far more than the bot should have different rules for.
+	maxCompiledRules = 1000
+
+	filterSearchMsgSuffix = `
+
+Please send the search to filter, exactly as it appears above.
+
+Or, you can send /cancel to cancel filtering a search alert.`
+
+	filterSearchFormat = `%s
+
+Send me the filters you want for <code>%s</code>, one per line, to replace these. Results that are excluded, or that don't match every rule, won't be sent to you.
+
+<code>exclude: word, another word</code> skips results with any of those words in their title or artist's name.
+<code>title: regexp</code>, <code>artist: regexp</code> and <code>rating: regexp</code> only send results that match the <a href="https://github.com/google/re2/wiki/Syntax">regular expression</a>. Case is ignored.
+
+Send <code>clear</code> to remove all of the filters, or /cancel to leave them as they are.`
+)
+
+var (
+	allRatings = []faapi.Rating{faapi.RatingGeneral, faapi.RatingMature, faapi.RatingAdult}
+
+	errNoRatings = errors.New("every rating would be hidden")
+
+	// compiledRules caches filter rules' regexps by their pattern, since many users may share them. It is emptied when
+	// it gets to maxCompiledRules, so it can't grow without end.
+	compiledRules      = map[string]*regexp.Regexp{}
+	compiledRulesMutex sync.Mutex
+)
+
+// wantsSubmission checks the submission against the user's filters for one of their subscriptions. Journals don't
+// have anything to filter on, so sub is nil for them and they are always wanted.
+func wantsSubmission(s *db.SubscriptionSettings, sub *faapi.Submission) bool {
+	if s == nil || sub == nil {
+		return true
+	}
+
+	// FA doesn't always say what a submission is rated. It could be anything, so a submission without a rating is only
+	// wanted if every rating is
+	if !ratingAllowed(s, sub.Rating) {
+		return false
+	}
+
+	title := strings.ToLower(sub.Title)
+	artist := strings.ToLower(sub.User)
+	for _, word := range s.Exclude {
+		if strings.Contains(title, word) || strings.Contains(artist, word) {
+			return false
+		}
+	}
+
+	for _, rule := range s.Rules {
+		field, re, err := parseRule(rule)
+		if err != nil {
+			// it was checked when it was saved, so this shouldn't happen. don't hide anything because of it
+			log.WithError(err).WithField("rule", rule).Error("Invalid filter rule")
+			continue
+		}
+		var value string
+		switch field {
+		case "title":
+			value = sub.Title
+		case "artist":
+			value = sub.User
+		case "rating":
+			// an unknown rating is empty, which a rule could match, so it never does
+			if sub.Rating == "" {
+				return false
+			}
+			value = string(sub.Rating)
+		}
+		if !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRule splits a filter rule into its field and compiled regexp. Rules ignore case, and are cached since they are
+// checked against every result.
+func parseRule(rule string) (string, *regexp.Regexp, error) {
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("rule %q doesn't have a field", rule)
+	}
+	field := strings.ToLower(strings.TrimSpace(parts[0]))
+	switch field {
+	case "title", "artist", "rating":
+	default:
+		return "", nil, fmt.Errorf("unknown field %q", field)
+	}
+
+	pattern := strings.TrimSpace(parts[1])
+	compiledRulesMutex.Lock()
+	defer compiledRulesMutex.Unlock()
+	re, exists := compiledRules[pattern]
+	if !exists {
+		var err error
+		re, err = regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(compiledRules) >= maxCompiledRules {
+			compiledRules = map[string]*regexp.Regexp{}
+		}
+		compiledRules[pattern] = re
+	}
+	return field, re, nil
+}
+
+// settingsSuffix describes any settings a subscription has, for lists.
+func settingsSuffix(user *db.TGUser, kind subscriptionKind, key string) string {
+	s := subscriptionSettings(user, kind, key)
+	if s == nil {
+		return ""
+	}
+
+	var parts []string
+	if s.Paused {
+		parts = append(parts, "paused")
+	}
+	if len(s.Ratings) > 0 {
+		parts = append(parts, strings.Join(s.Ratings, " and ")+" only")
+	}
+	if len(s.Exclude) > 0 || len(s.Rules) > 0 {
+		parts = append(parts, "filtered")
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+func ratingAllowed(s *db.SubscriptionSettings, rating faapi.Rating) bool {
+	if s == nil || len(s.Ratings) == 0 {
+		return true
+	}
+	for _, r := range s.Ratings {
+		if faapi.Rating(r) == rating {
+			return true
+		}
+	}
+	return false
+}
+
+// ratingLabel is how a submission's rating is shown, which FA doesn't always say.
+func ratingLabel(rating faapi.Rating) string {
+	if rating == "" {
+		return "rating unknown"
+	}
+	return string(rating)
+}
+
+// checkRatings cleans up imported ratings the same way the rating buttons would have saved them, or returns an error
+// if they aren't all ratings.
+func checkRatings(ratings []string) ([]string, error) {
+	allowed := make(map[faapi.Rating]bool)
+	for _, r := range ratings {
+		rating := faapi.Rating(strings.ToLower(strings.TrimSpace(r)))
+		if !isRating(rating) {
+			return nil, fmt.Errorf("%q isn't a rating", r)
+		}
+		allowed[rating] = true
+	}
+	if len(allowed) == len(allRatings) {
+		return nil, nil
+	}
+
+	var cleaned []string
+	for _, rating := range allRatings {
+		if allowed[rating] {
+			cleaned = append(cleaned, string(rating))
+		}
+	}
+	return cleaned, nil
+}
+
+func isRating(rating faapi.Rating) bool {
+	for _, r := range allRatings {
+		if r == rating {
+			return true
+		}
+	}
+	return false
+}
+
+// ratingKeyboard makes an inline keyboard to turn each rating on or off for one of the user's subscriptions.
+func (b *bot) ratingKeyboard(user *db.TGUser, kind subscriptionKind, key string) tgbotapi.InlineKeyboardMarkup {
+	s := subscriptionSettings(user, kind, key)
+	row := make([]tgbotapi.InlineKeyboardButton, len(allRatings))
+	for i, rating := range allRatings {
+		text := "Hide " + string(rating)
+		if !ratingAllowed(s, rating) {
+			text = "Show " + string(rating)
+		}
+		row[i] = tgbotapi.NewInlineKeyboardButtonData(text,
+			b.callbackData(callbackToggleRating+string(rating)[:1], int(user.ID), kind, key))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+// sendAdded tells the user their subscription was added. Submissions can be filtered by rating, so those get buttons
+// to do that right away.
+func (b *bot) sendAdded(userID int, kind subscriptionKind, key, msg string) {
+	if kind == journalsSubscription {
+		b.sendHTMLMessage(userID, "%s", msg)
+		return
+	}
+
+	user, err := b.db.GetTGUser(db.TelegramID(userID))
+	if err != nil || user == nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":   "sendAdded",
+			"userID": userID,
+		}).Error("Could not load user")
+		b.sendHTMLMessage(userID, "%s", msg)
+		return
+	}
+
+	m := tgbotapi.NewMessage(int64(userID), msg+ratingsPrompt)
+	m.ParseMode = "HTML"
+	m.ReplyMarkup = b.ratingKeyboard(user, kind, key)
+	b.send(userID, m)
+}
+
+// callbackRatings sends the rating buttons for a subscription from a list.
+func (b *bot) callbackRatings(q *tgbotapi.CallbackQuery, user *db.TGUser, kind subscriptionKind, key string) {
+	if kind == journalsSubscription {
+		b.answerCallback(q, "Journals don't have ratings.")
+		return
+	}
+
+	label := key
+	if kind != searchSubscription {
+		label = b.faUserName(key)
+	}
+	b.answerCallback(q, "")
+	m := tgbotapi.NewMessage(int64(q.From.ID),
+		fmt.Sprintf("Which ratings do you want alerts for from <code>%s</code>?", escapeHTML("%s", label)))
+	m.ParseMode = "HTML"
+	m.ReplyMarkup = b.ratingKeyboard(user, kind, key)
+	b.send(q.From.ID, m)
+}
+
+// toggledRating returns the rating a toggle button's action is for.
+func toggledRating(action string) (faapi.Rating, bool) {
+	if !strings.HasPrefix(action, callbackToggleRating) || len(action) != len(callbackToggleRating)+1 {
+		return "", false
+	}
+	for _, rating := range allRatings {
+		if string(rating)[:1] == action[len(callbackToggleRating):] {
+			return rating, true
+		}
+	}
+	return "", false
+}
+
+func (b *bot) callbackToggleRating(q *tgbotapi.CallbackQuery, kind subscriptionKind, key string,
+	rating faapi.Rating) {
+
+	logger := log.WithFields(log.Fields{
+		"func":     "callbackToggleRating",
+		"userID":   q.From.ID,
+		"username": q.From.UserName,
+		"kind":     kind,
+		"key":      key,
+		"rating":   rating,
+	})
+
+	var user *db.TGUser
+	err := b.db.UpdateTGUser(db.TelegramID(q.From.ID), func(u *db.TGUser) error {
+		user = u
+		s := editSubscriptionSettings(u, kind, key)
+		var ratings []string
+		for _, r := range allRatings {
+			allowed := ratingAllowed(s, r)
+			if r == rating {
+				allowed = !allowed
+			}
+			if allowed {
+				ratings = append(ratings, string(r))
+			}
+		}
+		if len(ratings) == 0 {
+			return errNoRatings
+		}
+		if len(ratings) == len(allRatings) {
+			ratings = nil
+		}
+		s.Ratings = ratings
+		return nil
+	})
+	switch err {
+	case nil:
+	case errNoRatings:
+		b.answerCallback(q, "You have to leave at least one rating. Pause it from the list instead.")
+		return
+	default:
+		logger.WithError(err).Error("Unable to save ratings for user")
+		b.answerCallback(q, fmt.Sprintf(saveFailedFormat, "change"))
+		return
+	}
+
+	if ratingAllowed(subscriptionSettings(user, kind, key), rating) {
+		b.answerCallback(q, "You will get alerts for "+string(rating)+" submissions.")
+	} else {
+		b.answerCallback(q, "You won't get alerts for "+string(rating)+" submissions.")
+	}
+	if q.Message != nil {
+		b.send(q.From.ID, tgbotapi.NewEditMessageReplyMarkup(q.Message.Chat.ID, q.Message.MessageID,
+			b.ratingKeyboard(user, kind, key)))
+	}
+}
+
+// cmdFilterSearch sets exclude words and rules on one of the user's searches. The search can be given as the command's
+// arguments, otherwise the user's searches are listed and they are asked which to filter.
+func (b *bot) cmdFilterSearch(u *tgbotapi.User, args string) {
+	if args != "" {
+		if b.userStartedBot(u.ID) {
+			b.filterSearchFrom(u, args)
+		}
+		return
+	}
+
+	msg, _ := b.getSearchesToSend(u)
+	if msg == "" {
+		return
+	}
+
+	b.plaintextHandler[u.ID] = b.filterSearchCallback
+	b.sendHTMLMessage(u.ID, msg+filterSearchMsgSuffix)
+}
+
+func (b *bot) filterSearchCallback(m *tgbotapi.Message) {
+	b.filterSearchFrom(m.From, m.Text)
+}
+
+// filterSearchFrom shows the search's current filters, and asks for new ones.
+func (b *bot) filterSearchFrom(u *tgbotapi.User, search string) {
+	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
+	if err != nil || user == nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":   "filterSearchFrom",
+			"userID": u.ID,
+		}).Error("Could not load user")
+		b.sendMessage(u.ID, loadFailedFormat, "your saved searches")
+		return
+	}
+	search = searchKey(search)
+	if !user.Searches[search] {
+		b.sendMessage(u.ID, "I couldn't find that search.")
+		return
+	}
+
+	current := "That search doesn't have any filters."
+	if s := subscriptionSettings(user, searchSubscription, search); s != nil && (len(s.Exclude) > 0 ||
+		len(s.Rules) > 0) {
+		current = "That search has these filters:\n" + formatFilters(s.Exclude, s.Rules)
+	}
+
+	b.plaintextHandler[u.ID] = func(m *tgbotapi.Message) {
+		b.filterSearch(m.From, search, m.Text)
+	}
+	m := tgbotapi.NewMessage(int64(u.ID), fmt.Sprintf(filterSearchFormat, current, escapeHTML("%s", search)))
+	m.ParseMode = "HTML"
+	m.DisableWebPagePreview = true
+	b.send(u.ID, m)
+}
+
+func (b *bot) filterSearch(u *tgbotapi.User, search, text string) {
+	logger := log.WithFields(log.Fields{
+		"func":     "filterSearch",
+		"userID":   u.ID,
+		"username": u.UserName,
+		"search":   search,
+	})
+
+	exclude, rules, problem := parseFilters(text)
+	if problem != "" {
+		b.sendHTMLMessage(u.ID, "%s Please send /filtersearch to try again.", escapeHTML("%s", problem))
+		return
+	}
+
+	err := b.db.UpdateTGUser(db.TelegramID(u.ID), func(user *db.TGUser) error {
+		if !user.Searches[search] {
+			return db.ErrNoSearch
+		}
+		s := editSubscriptionSettings(user, searchSubscription, search)
+		s.Exclude = exclude
+		s.Rules = rules
+		return nil
+	})
+	switch {
+	case err == db.ErrNoSearch:
+		b.sendMessage(u.ID, "I couldn't find that search.")
+	case err != nil:
+		logger.WithError(err).Error("Unable to save filters for user")
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "search filter"))
+	case len(exclude) == 0 && len(rules) == 0:
+		b.sendHTMLMessage(u.ID, "<code>%s</code> isn't filtered anymore.", escapeHTML("%s", search))
+	default:
+		b.sendHTMLMessage(u.ID, "<code>%s</code> is filtered by:\n%s", escapeHTML("%s", search),
+			formatFilters(exclude, rules))
+	}
+}
+
+// parseFilters parses the filters a user sent, one per line. If there's something wrong with them, problem says what.
+func parseFilters(text string) (exclude, rules []string, problem string) {
+	if strings.EqualFold(strings.TrimSpace(text), "clear") {
+		return nil, nil, ""
+	}
+
+	exclude, rules, problem = checkFilters(strings.Split(text, "\n"))
+	if problem == "" && len(exclude) == 0 && len(rules) == 0 {
+		return nil, nil, "I didn't find any filters in that."
+	}
+	return exclude, rules, problem
+}
+
+// checkImportedFilters cleans up imported exclude words and rules the same way they would have been saved if the user
+// had sent them. If there's something wrong with them, problem says what.
+func checkImportedFilters(exclude, rules []string) ([]string, []string, string) {
+	var lines []string
+	if len(exclude) > 0 {
+		lines = append(lines, "exclude: "+strings.Join(exclude, ", "))
+	}
+	return checkFilters(append(lines, rules...))
+}
+
+// checkFilters parses filter lines, each an exclude list or a rule. Blank lines are skipped.
+func checkFilters(lines []string) (exclude, rules []string, problem string) {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) > maxFilterLength {
+			return nil, nil, fmt.Sprintf("Filters can't be longer than %d characters.", maxFilterLength)
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Sprintf("I don't understand the filter %q.", line)
+		}
+		if strings.EqualFold(strings.TrimSpace(parts[0]), "exclude") {
+			for _, word := range strings.Split(parts[1], ",") {
+				word = strings.ToLower(strings.TrimSpace(word))
+				if word != "" {
+					exclude = append(exclude, word)
+				}
+			}
+			continue
+		}
+
+		field, _, err := parseRule(line)
+		if err != nil {
+			return nil, nil, fmt.Sprintf("I don't understand the filter %q: %s.", line, err)
+		}
+		rules = append(rules, field+":"+strings.TrimSpace(parts[1]))
+	}
+
+	if len(exclude)+len(rules) > maxFilterRules {
+		return nil, nil, fmt.Sprintf("An alert can't have more than %d filters.", maxFilterRules)
+	}
+	return exclude, rules, ""
+}
+
+func formatFilters(exclude, rules []string) string {
+	var lines []string
+	if len(exclude) > 0 {
+		lines = append(lines, "<code>exclude: "+escapeHTML("%s", strings.Join(exclude, ", "))+"</code>")
+	}
+	for _, rule := range rules {
+		lines = append(lines, "<code>"+escapeHTML("%s", strings.Replace(rule, ":", ": ", 1))+"</code>")
+	}
+	return strings.Join(lines, "\n")
+}
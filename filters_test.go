@@ -0,0 +1,78 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/ajanata/faapi"
+	"github.com/ajanata/fanotify/db"
+)
+
+func TestWantsSubmission(t *testing.T) {
+	general := []string{string(faapi.RatingGeneral)}
+	tests := []struct {
+		name     string
+		settings *db.SubscriptionSettings
+		sub      *faapi.Submission
+		want     bool
+	}{
+		{"no settings", nil, &faapi.Submission{Rating: faapi.RatingAdult}, true},
+		{"journal", &db.SubscriptionSettings{Ratings: general}, nil, true},
+		{"every rating", &db.SubscriptionSettings{}, &faapi.Submission{Rating: faapi.RatingAdult}, true},
+		{"allowed rating", &db.SubscriptionSettings{Ratings: general}, &faapi.Submission{Rating: faapi.RatingGeneral},
+			true},
+		{"other rating", &db.SubscriptionSettings{Ratings: general}, &faapi.Submission{Rating: faapi.RatingAdult},
+			false},
+		{"unknown rating with every rating", &db.SubscriptionSettings{}, &faapi.Submission{}, true},
+		{"unknown rating with a rating filter", &db.SubscriptionSettings{Ratings: general}, &faapi.Submission{},
+			false},
+		{"unknown rating with a rating rule",
+			&db.SubscriptionSettings{Rules: []string{"rating:.*"}}, &faapi.Submission{}, false},
+		{"rating rule", &db.SubscriptionSettings{Rules: []string{"rating:^(general|mature)$"}},
+			&faapi.Submission{Rating: faapi.RatingMature}, true},
+		{"rating rule not matched", &db.SubscriptionSettings{Rules: []string{"rating:^(general|mature)$"}},
+			&faapi.Submission{Rating: faapi.RatingAdult}, false},
+		{"excluded word in title", &db.SubscriptionSettings{Exclude: []string{"wip"}},
+			&faapi.Submission{Title: "Dragon WIP", Rating: faapi.RatingGeneral}, false},
+		{"excluded word in artist", &db.SubscriptionSettings{Exclude: []string{"wip"}},
+			&faapi.Submission{Title: "Dragon", User: "WipArtist", Rating: faapi.RatingGeneral}, false},
+		{"title rule ignores case", &db.SubscriptionSettings{Rules: []string{"title:^dragon"}},
+			&faapi.Submission{Title: "Dragon", Rating: faapi.RatingGeneral}, true},
+		{"every rule must match", &db.SubscriptionSettings{Rules: []string{"title:^dragon", "artist:^someone$"}},
+			&faapi.Submission{Title: "Dragon", User: "someone_else", Rating: faapi.RatingGeneral}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := wantsSubmission(test.settings, test.sub); got != test.want {
+				t.Errorf("wantsSubmission(%+v, %v) = %t, want %t", test.settings, test.sub, got, test.want)
+			}
+		})
+	}
+}
@@ -26,3 +26,6 @@ require (
 )
 
 go 1.13
+
+// faapi is forked here for the changes fanotify needs until they are upstream.
+replace github.com/ajanata/faapi => ./third_party/faapi
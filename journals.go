@@ -41,6 +41,8 @@ const (
 
 Or, you can send /cancel to cancel adding a journal alert.`
 
+	listJournalsSuffix = "\n\nTap a button below to pause or remove one, or send /deljournals to remove one."
+
 	delJournalsMsgSuffix = `
 
 Please send the username you no longer wish to monitor for new journals.
@@ -48,44 +50,64 @@ Please send the username you no longer wish to monitor for new journals.
 Or, you can send /cancel to cancel deleting a journal alert.`
 )
 
-func (b *bot) cmdAddJournals(u *tgbotapi.User) {
+// cmdAddJournals adds the user given as the command's arguments, or asks for the user if there weren't any.
+func (b *bot) cmdAddJournals(u *tgbotapi.User, args string) {
 	if !b.userStartedBot(u.ID) {
 		return
 	}
 
+	if args != "" {
+		b.runInBackground(func() { b.addJournals(u, args) })
+		return
+	}
+
 	b.plaintextHandler[u.ID] = b.addJournalsCallback
 	b.sendMessage(u.ID, addJournalsMsg)
 }
 
 func (b *bot) addJournalsCallback(m *tgbotapi.Message) {
+	b.runInBackground(func() { b.addJournals(m.From, m.Text) })
+}
+
+// addJournals checks that the user exists on FurAffinity before saving the alert. That can take a while with FA's rate
+// limit, so this is run in its own goroutine instead of holding up the update loop.
+func (b *bot) addJournals(u *tgbotapi.User, faUser string) {
+	defer logPanic()
 	logger := log.WithFields(log.Fields{
-		"func":     "addJournalsCallback",
-		"userID":   m.From.ID,
-		"username": m.From.UserName,
+		"func":     "addJournals",
+		"userID":   u.ID,
+		"username": u.UserName,
 	})
 
-	// TODO make sure it's a valid fa username
+	name, ok := b.lookupFAUser(u, faUser)
+	if !ok {
+		return
+	}
 
-	err := b.db.AddUserJournalsForUser(db.TelegramID(m.From.ID), m.Text)
+	err := b.db.AddUserJournalsForUser(db.TelegramID(u.ID), faUser, name)
 	if err != nil {
 		logger.WithError(err).Error("Unable to add journals for user")
-		b.sendMessage(m.From.ID, fmt.Sprintf(saveFailedFormat, "user journal alert"))
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "user journal alert"))
 	} else {
-		b.sendHTMLMessage(m.From.ID, "I will alert you to any new journals from <code>%s</code> now.", m.Text)
+		b.sendHTMLMessage(u.ID, "I will alert you to any new journals from <code>%s</code> now.", escapeHTML(b.faUserName(faUser)))
 	}
 }
 
 func (b *bot) cmdListJournals(u *tgbotapi.User) {
-	msg := b.getMonitoredUsersToSend(u, true)
-	if msg == "" {
+	b.sendSubscriptionList(u, journalsSubscription)
+}
+
+// cmdDelJournals deletes the user given as the command's arguments, or lists the monitored users and asks which to
+// delete if there weren't any.
+func (b *bot) cmdDelJournals(u *tgbotapi.User, args string) {
+	if args != "" {
+		if b.userStartedBot(u.ID) {
+			b.delJournals(u, args)
+		}
 		return
 	}
-	msg = msg + "\n\nSend /deljournals to remove one."
-	b.sendHTMLMessage(u.ID, msg)
-}
 
-func (b *bot) cmdDelJournals(u *tgbotapi.User) {
-	msg := b.getMonitoredUsersToSend(u, true)
+	msg, _ := b.getMonitoredUsersToSend(u, true)
 	if msg == "" {
 		return
 	}
@@ -95,20 +117,25 @@ func (b *bot) cmdDelJournals(u *tgbotapi.User) {
 }
 
 func (b *bot) delJournalsCallback(m *tgbotapi.Message) {
+	b.delJournals(m.From, m.Text)
+}
+
+func (b *bot) delJournals(u *tgbotapi.User, faUser string) {
 	logger := log.WithFields(log.Fields{
-		"func":     "delJournalsCallback",
-		"userID":   m.From.ID,
-		"username": m.From.UserName,
+		"func":     "delJournals",
+		"userID":   u.ID,
+		"username": u.UserName,
 	})
 
-	err := b.db.DeleteUserJournalsForUser(db.TelegramID(m.From.ID), m.Text)
+	err := b.db.DeleteUserJournalsForUser(db.TelegramID(u.ID), faUser)
 	switch err {
 	case db.ErrNoFAUser:
-		b.sendMessage(m.From.ID, "I couldn't find that user.")
+		b.sendMessage(u.ID, "I couldn't find that user.")
 	case nil:
-		b.sendHTMLMessage(m.From.ID, "I will no longer alert you to any new journals from <code>%s</code>.", m.Text)
+		b.sendHTMLMessage(u.ID, "I will no longer alert you to any new journals from <code>%s</code>.",
+			escapeHTML(faUser))
 	default:
 		logger.WithError(err).Error("Unable to delete journals for user")
-		b.sendMessage(m.From.ID, fmt.Sprintf(saveFailedFormat, "user journal alert deletion"))
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "user journal alert deletion"))
 	}
 }
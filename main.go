@@ -31,7 +31,10 @@ package main
 import (
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/ajanata/faapi"
@@ -109,6 +112,26 @@ func main() {
 	}
 	defer d.Close()
 
+	// searches used to be saved exactly as they were sent, so equivalent ones need to be combined
+	migrated, err := d.CanonicalizeSearches(func(search string) (string, error) {
+		canonical, err := canonicalSearch(search)
+		if err != nil {
+			log.WithError(err).WithField("search", search).Warn("Unable to parse saved search, leaving it as is")
+		}
+		return canonical, err
+	}, func(search string, userID db.TelegramID, problem error) {
+		log.WithError(problem).WithFields(log.Fields{
+			"search": search,
+			"userID": userID,
+		}).Warn("Repaired inconsistent search subscription")
+	})
+	if err != nil {
+		log.WithError(err).Fatal("Unable to migrate searches.")
+	}
+	if migrated > 0 {
+		log.WithField("searches", migrated).Info("Migrated searches to their canonical form.")
+	}
+
 	// Create FurAffinity API client.
 	fa, err := faapi.New(c.FA.faAPIConfig())
 	if err != nil {
@@ -137,6 +160,16 @@ func main() {
 
 	// Finally, make the bot and run it.
 	bot := newBot(c, d, fa, tg)
+
+	// Shut down gracefully when asked to by the OS, e.g. by systemd or docker.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.WithField("signal", sig).Warn("Received signal")
+		bot.stop()
+	}()
+
 	// Run does not return unless the bot is gracefully shutting down.
 	bot.run()
 }
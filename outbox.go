@@ -0,0 +1,303 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/ajanata/fanotify/db"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// outboxPollInterval is how often the outbox is checked for alerts that are due to be retried.
+	outboxPollInterval     = time.Second
+	outboxBatchSize        = 20
+	defaultMaxSendAttempts = 10
+	maxSendBackoff         = time.Hour
+)
+
+var (
+	// uploads don't give us the structured error, so we have to dig it out of the message
+	retryAfterRegexp = regexp.MustCompile(`retry after (\d+)`)
+)
+
+type (
+	// delivery is how an alert should be delivered to a user.
+	delivery struct {
+		// holdUntil keeps the alert from being sent until then, if it is set.
+		holdUntil time.Time
+		// collapse sends the alert in a summary with the user's other collapsed alerts.
+		collapse bool
+		// digestDue puts the alert in the user's digest that is due then instead, if it is set.
+		digestDue time.Time
+	}
+)
+
+// queueAlert puts a copy of the alert in the outbox to be sent to the user by the sender. If fb is non-nil, it will be
+// sent as an image message with the notification's text as its HTML caption. Otherwise, it will be sent as a regular
+// HTML message.
+//
+// Submission alerts wait in the outbox for a little while, so that anything else that finds the submission can be added
+// to them.
+func (b *bot) queueAlert(userID int, fb *tgbotapi.FileBytes, alert db.Notification, d delivery) {
+	n := &alert
+	n.UserID = db.TelegramID(userID)
+	n.NextAttempt = d.holdUntil
+	n.Held = !d.holdUntil.IsZero()
+	n.Collapse = d.collapse
+	if n.SubmissionID != 0 {
+		window := b.c.TG.MergeWindow.convert()
+		if window <= 0 {
+			window = b.c.FA.PollInterval.convert()
+		}
+		if merge := time.Now().Add(window); merge.After(n.NextAttempt) {
+			n.NextAttempt = merge
+		}
+	}
+	if fb != nil {
+		n.PhotoName = fb.Name
+		n.Photo = fb.Bytes
+	}
+
+	err := b.db.QueueNotification(n)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":   "queueAlert",
+			"userID": userID,
+		}).Error("Unable to queue alert, sending it immediately")
+		b.send(userID, notificationMessage(n))
+		return
+	}
+
+	b.wakeSender()
+}
+
+// wakeSender makes the sender check the outbox now, unless it's already been woken up.
+func (b *bot) wakeSender() {
+	select {
+	case b.outboxReady <- struct{}{}:
+	default:
+	}
+}
+
+// sender sends the alerts in the outbox. When the bot is stopping, it keeps sending anything that is due until the
+// shutdown deadline. Anything left in the outbox after that will be sent once the bot starts again.
+func (b *bot) sender() {
+	defer logPanic()
+	defer b.backgroundJobs.Done()
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.shouldQuit:
+			log.Info("flushing outbox before stopping sender")
+			b.drainOutbox(b.shutdownDeadline)
+			log.Info("stopping sender")
+			return
+		case <-b.outboxReady:
+		case <-ticker.C:
+		}
+		b.drainOutbox(b.shouldQuit)
+	}
+}
+
+// drainOutbox sends every alert in the outbox that is due, until the outbox is empty, Telegram tells us to slow down,
+// or stop is closed. Chats that have used up their rate limit are passed over until they can be sent to again, so one
+// busy chat doesn't hold up everyone else.
+func (b *bot) drainOutbox(stop <-chan struct{}) {
+	logger := log.WithField("func", "drainOutbox")
+	limited := func(userID db.TelegramID) bool {
+		return !b.sendLimiter.ready(int(userID))
+	}
+
+	for {
+		if time.Now().Before(b.sendPausedUntil) {
+			return
+		}
+
+		ns, err := b.db.DueNotifications(time.Now(), outboxBatchSize, limited)
+		if err != nil {
+			logger.WithError(err).Error("Unable to load outbox")
+			return
+		}
+		if len(ns) == 0 {
+			return
+		}
+
+		sent := 0
+	batch:
+		for _, n := range ns {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if limited(n.UserID) {
+				// sending to them earlier in this batch used it up
+				continue
+			}
+
+			if n.Collapse {
+				if !b.collapseNotifications(n.UserID, logger) {
+					return
+				}
+				// that replaced some of the rest of this batch
+				break batch
+			}
+
+			if !b.sendNotification(n) {
+				return
+			}
+			sent++
+		}
+		if sent == 0 {
+			// everything that's due has to wait for its chat's limit, which the ticker will come back for
+			return
+		}
+	}
+}
+
+// sendNotification tries to send a single alert from the outbox, removing it if it was sent and scheduling a retry if
+// it was not. Alerts by an artist the user has blocked since they were queued are removed without being sent. Returns
+// false if the sender should stop for now.
+func (b *bot) sendNotification(n *db.Notification) bool {
+	logger := log.WithFields(log.Fields{
+		"func":     "sendNotification",
+		"id":       n.ID,
+		"userID":   n.UserID,
+		"attempts": n.Attempts,
+	})
+
+	// triggers may have been merged into it since it was loaded, and once it's claimed nothing else can be
+	n, err := b.db.ClaimNotification(n.ID)
+	if err != nil {
+		logger.WithError(err).Error("Unable to claim alert from outbox")
+		return false
+	}
+	if n == nil {
+		// it was replaced by a summary since it was loaded
+		return true
+	}
+
+	// the artist may have been blocked while this was waiting to be sent
+	if n.Artist != "" {
+		user, err := b.db.GetTGUser(n.UserID)
+		if err != nil {
+			logger.WithError(err).Error("Could not load user to check blocked artists")
+		} else if user != nil && user.Blocked(n.Artist) {
+			logger.WithField("artist", n.Artist).Debug("Dropping alert from blocked artist")
+			return b.deleteNotification(n, logger)
+		}
+	}
+
+	err = b.deliver(int(n.UserID), notificationMessage(n))
+	if err == nil {
+		// if this keeps failing, we'd just keep sending it
+		return b.deleteNotification(n, logger)
+	}
+
+	// it's due now, so it isn't being held for the user anymore
+	n.Held = false
+	if wait, ok := retryAfter(err); ok {
+		// this applies to everything we send, not just this alert
+		b.sendPausedUntil = time.Now().Add(wait)
+		n.NextAttempt = b.sendPausedUntil
+		logger.WithError(err).WithField("retry_after", wait).Warn("Telegram asked us to slow down")
+		b.saveNotification(n, logger)
+		return false
+	}
+
+	n.Attempts++
+	max := b.c.TG.MaxSendAttempts
+	if max <= 0 {
+		max = defaultMaxSendAttempts
+	}
+	if n.Attempts >= max {
+		logger.WithError(err).Error("Unable to send alert, giving up")
+		return b.deleteNotification(n, logger)
+	}
+
+	n.NextAttempt = time.Now().Add(sendBackoff(n.Attempts))
+	logger.WithError(err).WithField("next_attempt", n.NextAttempt).Info("Unable to send alert, will retry")
+	return b.saveNotification(n, logger)
+}
+
+func (b *bot) deleteNotification(n *db.Notification, logger *log.Entry) bool {
+	err := b.db.DeleteNotification(n.ID)
+	if err != nil {
+		logger.WithError(err).Error("Unable to remove alert from outbox")
+		return false
+	}
+	return true
+}
+
+func (b *bot) saveNotification(n *db.Notification, logger *log.Entry) bool {
+	err := b.db.SaveNotification(n)
+	if err != nil {
+		logger.WithError(err).Error("Unable to save alert in outbox")
+		return false
+	}
+	return true
+}
+
+// sendBackoff is how long to wait before trying to send an alert again after the given number of attempts.
+func sendBackoff(attempts int) time.Duration {
+	d := time.Second
+	for i := 0; i < attempts && d < maxSendBackoff; i++ {
+		d *= 2
+	}
+	if d > maxSendBackoff {
+		d = maxSendBackoff
+	}
+	return d
+}
+
+// retryAfter checks whether err is Telegram telling us to slow down, and if so, how long it wants us to wait.
+func retryAfter(err error) (time.Duration, bool) {
+	if tgErr, ok := err.(tgbotapi.Error); ok && tgErr.RetryAfter > 0 {
+		return time.Duration(tgErr.RetryAfter) * time.Second, true
+	}
+
+	m := retryAfterRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
@@ -0,0 +1,288 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajanata/faapi"
+	"github.com/ajanata/fanotify/db"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxSnooze keeps snoozes from overflowing, and anyone who wants longer probably wants /stop.
+	maxSnooze = 365 * 24 * time.Hour
+
+	snoozeTimeFormat = "Mon Jan 2 15:04 MST"
+
+	snoozeUsageMsg = `Send <code>/snooze</code> with how long to silence all of your alerts, like <code>/snooze 8h</code> or <code>/snooze 2d</code>. Anything that would have been sent while snoozed is skipped.
+
+Add <code>hold</code>, like <code>/snooze 8h hold</code>, to get those alerts when the snooze ends instead.
+
+Send <code>/snooze off</code> to end a snooze early.`
+)
+
+// settingsMap returns the user's settings map for subscriptions of the given kind.
+func settingsMap(user *db.TGUser, kind subscriptionKind) *map[string]*db.SubscriptionSettings {
+	switch kind {
+	case searchSubscription:
+		return &user.SearchSettings
+	case submissionsSubscription:
+		return &user.SubmissionUserSettings
+	case journalsSubscription:
+		return &user.JournalUserSettings
+	default:
+		return nil
+	}
+}
+
+// subscriptionSettings returns the user's settings for one of their subscriptions, or nil if it doesn't have any.
+func subscriptionSettings(user *db.TGUser, kind subscriptionKind, key string) *db.SubscriptionSettings {
+	m := settingsMap(user, kind)
+	if m == nil {
+		return nil
+	}
+	return (*m)[key]
+}
+
+// editSubscriptionSettings returns the user's settings for one of their subscriptions, creating them if needed so that
+// they can be changed. The user still has to be saved afterwards.
+func editSubscriptionSettings(user *db.TGUser, kind subscriptionKind, key string) *db.SubscriptionSettings {
+	m := settingsMap(user, kind)
+	if *m == nil {
+		*m = make(map[string]*db.SubscriptionSettings)
+	}
+	s, exists := (*m)[key]
+	if !exists {
+		s = &db.SubscriptionSettings{}
+		(*m)[key] = s
+	}
+	return s
+}
+
+func isPaused(user *db.TGUser, kind subscriptionKind, key string) bool {
+	s := subscriptionSettings(user, kind, key)
+	return s != nil && s.Paused
+}
+
+// alertDelivery decides how to deliver an alert for one of the user's subscriptions. If ok is false, the alert should
+// not be sent at all. sub is the submission the alert is for, or nil for journals.
+//
+// This is where the user's blocked artists are enforced, since every kind of alert comes through here.
+//
+// Alerts that are skipped aren't marked as delivered, so something that also matches another subscription is still
+// sent for that one.
+func (b *bot) alertDelivery(userID int, kind subscriptionKind, key string, sub *faapi.Submission) (d delivery,
+	ok bool) {
+
+	user, err := b.db.GetTGUser(db.TelegramID(userID))
+	if err != nil || user == nil {
+		// better to send something they didn't want than to lose something they did
+		log.WithError(err).WithFields(log.Fields{
+			"func":   "alertDelivery",
+			"userID": userID,
+		}).Error("Could not load user")
+		return delivery{}, true
+	}
+
+	if (sub != nil && user.Blocked(sub.User)) || (kind != searchSubscription && user.Blocked(key)) {
+		return delivery{}, false
+	}
+
+	settings := subscriptionSettings(user, kind, key)
+	if settings != nil && (settings.Paused || !wantsSubmission(settings, sub)) {
+		return delivery{}, false
+	}
+
+	now := time.Now()
+	if user.Snoozed(now) && !user.SnoozeHold {
+		return delivery{}, false
+	}
+
+	if user.DeliveryMode != db.DeliverImmediately {
+		d.digestDue = digestDue(user, now)
+		return d, true
+	}
+
+	if release := releaseTime(user, now); release.After(now) {
+		d.holdUntil = release
+		d.collapse = user.QuietHours != nil && user.QuietHours.Summary
+	}
+	return d, true
+}
+
+func (b *bot) callbackPause(q *tgbotapi.CallbackQuery, kind subscriptionKind, key string) {
+	logger := log.WithFields(log.Fields{
+		"func":     "callbackPause",
+		"userID":   q.From.ID,
+		"username": q.From.UserName,
+		"kind":     kind,
+		"key":      key,
+	})
+
+	label := key
+	if kind != searchSubscription {
+		label = b.faUserName(key)
+	}
+
+	var paused bool
+	err := b.db.UpdateTGUser(db.TelegramID(q.From.ID), func(user *db.TGUser) error {
+		s := editSubscriptionSettings(user, kind, key)
+		s.Paused = !s.Paused
+		paused = s.Paused
+		return nil
+	})
+	switch {
+	case err != nil:
+		logger.WithError(err).Error("Unable to pause subscription for user")
+		b.answerCallback(q, fmt.Sprintf(saveFailedFormat, "change"))
+	case paused:
+		b.answerCallback(q, "Paused "+label+". You won't get what it finds until you resume it.")
+	default:
+		b.answerCallback(q, "Resumed "+label+".")
+	}
+	b.refreshSubscriptionList(q, kind)
+}
+
+// cmdSnooze silences all of the user's alerts for a while.
+func (b *bot) cmdSnooze(u *tgbotapi.User, args string) {
+	logger := log.WithFields(log.Fields{
+		"func":     "cmdSnooze",
+		"userID":   u.ID,
+		"username": u.UserName,
+		"args":     args,
+	})
+
+	if !b.userStartedBot(u.ID) {
+		return
+	}
+
+	fields := strings.Fields(strings.ToLower(args))
+	if len(fields) == 0 {
+		b.snoozeStatus(u)
+		return
+	}
+
+	now := time.Now()
+	var until time.Time
+	var hold bool
+	if fields[0] == "off" {
+		// held alerts are released below, since until isn't after now
+		until = now
+	} else {
+		d, err := parseSnoozeDuration(fields[0])
+		if err != nil || len(fields) > 2 || (len(fields) == 2 && fields[1] != "hold") {
+			b.sendHTMLMessage(u.ID, snoozeUsageMsg)
+			return
+		}
+		until = now.Add(d)
+		hold = len(fields) == 2
+	}
+
+	var release time.Time
+	loc := time.UTC
+	err := b.db.UpdateTGUser(db.TelegramID(u.ID), func(user *db.TGUser) error {
+		user.SnoozedUntil = until
+		user.SnoozeHold = hold
+		release = releaseTime(user, now)
+		loc = user.Location()
+		return nil
+	})
+	if err == nil {
+		// anything already held follows the new snooze
+		err = b.db.RescheduleHeldNotifications(db.TelegramID(u.ID), release)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Unable to save snooze")
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "snooze"))
+		return
+	}
+
+	switch {
+	case !until.After(now):
+		b.sendMessage(u.ID, "Your alerts are no longer snoozed.")
+	case hold:
+		b.sendMessage(u.ID, "Your alerts are snoozed until %s. I'll send what I find when the snooze ends.",
+			until.In(loc).Format(snoozeTimeFormat))
+	default:
+		b.sendMessage(u.ID, "Your alerts are snoozed until %s.", until.In(loc).Format(snoozeTimeFormat))
+	}
+	// in case that released anything
+	b.wakeSender()
+}
+
+func (b *bot) snoozeStatus(u *tgbotapi.User) {
+	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
+	if err != nil || user == nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":   "snoozeStatus",
+			"userID": u.ID,
+		}).Error("Could not load user")
+		b.sendMessage(u.ID, loadFailedFormat, "your snooze")
+		return
+	}
+
+	if user.Snoozed(time.Now()) {
+		b.sendHTMLMessage(u.ID, "Your alerts are snoozed until %s.\n\n%s",
+			user.SnoozedUntil.In(user.Location()).Format(snoozeTimeFormat), snoozeUsageMsg)
+		return
+	}
+	b.sendHTMLMessage(u.ID, snoozeUsageMsg)
+}
+
+// parseSnoozeDuration parses a Go duration, or a whole number of days like "2d" since Go doesn't have those.
+func parseSnoozeDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		if days > int(maxSnooze/(24*time.Hour)) {
+			return 0, fmt.Errorf("snooze of %s is too long", s)
+		}
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		d, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if d <= 0 || d > maxSnooze {
+		return 0, fmt.Errorf("snooze of %s is out of range", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,558 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/ajanata/faapi"
+)
+
+type (
+	// queryNode is part of a parsed FurAffinity search.
+	queryNode struct {
+		kind queryNodeKind
+		// text is the word, the phrase with any proximity or quorum suffix, or the field name.
+		text  string
+		nodes []*queryNode
+	}
+
+	queryNodeKind int
+
+	queryToken struct {
+		kind queryTokenKind
+		text string
+	}
+
+	queryTokenKind int
+)
+
+const (
+	wordNode queryNodeKind = iota
+	phraseNode
+	// fieldNode limits the words after it in the same group to a field, like @keywords.
+	fieldNode
+	notNode
+	orNode
+	// groupNode is words that must all match, in parentheses unless it is the whole query.
+	groupNode
+)
+
+const (
+	wordToken queryTokenKind = iota
+	phraseToken
+	fieldToken
+	notToken
+	orToken
+	openToken
+	closeToken
+	// optionToken narrows the whole search down to a submission type or rating, like #art.
+	optionToken
+)
+
+var (
+	errQueryEmpty        = errors.New("it doesn't have anything to search for")
+	errQueryUnclosed     = errors.New(`it has a " without a matching " to end the phrase`)
+	errQueryEmptyPhrase  = errors.New(`it has "" with nothing between them`)
+	errQueryField        = errors.New("@ needs a single field name after it, like @keywords")
+	errQueryOpenParen    = errors.New("it has a ( without a matching )")
+	errQueryCloseParen   = errors.New("it has a ) without a matching (")
+	errQueryEmptyParens  = errors.New("it has () with nothing between them")
+	errQueryOr           = errors.New("| needs something to search for on both sides of it")
+	errQueryNot          = errors.New("! and - need a word, phrase or parentheses right after them")
+	errQueryOnlyExcluded = errors.New("it has to have something to find that isn't excluded with ! or -")
+	errQueryOption       = errors.New("# needs an option name after it, like #art")
+	errQueryNotOption    = errors.New("options like #art can't be excluded. Leave them out to search everything")
+
+	// unsupportedQueryRegexp matches the rest of FurAffinity's search operators, which depend on the order of the words
+	// around them. Rather than risk changing what a search means by sorting it, searches using them are turned away.
+	// The keywords are only operators in upper case.
+	unsupportedQueryRegexp = regexp.MustCompile(`<<|&|^(NEAR/\d+|SENTENCE|PARAGRAPH|MAYBE)$|^(ZONE|ZONESPAN):`)
+)
+
+// canonicalSearch checks that the search is valid in FurAffinity's extended search syntax, and rewrites it so that
+// searches that mean the same thing are written the same way: lower case, with single spaces, ! instead of -, the
+// words that must all match sorted, and any options at the end in the order FurAffinity lists them. Searches are saved
+// this way, so that everyone with the same search shares it.
+func canonicalSearch(search string) (string, error) {
+	query, options, err := parseSearchQuery(search)
+	if err != nil {
+		return "", err
+	}
+	return query + formatSearchOptions(options), nil
+}
+
+// splitSearch splits a saved search into its query and its options, to be run. Searches that can't be parsed were saved
+// before searches were checked, and are run as they are.
+func splitSearch(search string) (string, faapi.SearchOptions) {
+	query, options, err := parseSearchQuery(search)
+	if err != nil {
+		return search, faapi.SearchOptions{}
+	}
+	return query, options
+}
+
+// parseSearchQuery checks the search, returning its query in canonical form and its options.
+func parseSearchQuery(search string) (string, faapi.SearchOptions, error) {
+	var options faapi.SearchOptions
+	tokens, err := tokenizeQuery(search)
+	if err != nil {
+		return "", options, err
+	}
+
+	// options apply to the whole search wherever they are, so they're taken out before it's parsed
+	types := make(map[faapi.SubmissionType]bool)
+	ratings := make(map[faapi.Rating]bool)
+	var query []queryToken
+	for i, t := range tokens {
+		if t.kind != optionToken {
+			query = append(query, t)
+			continue
+		}
+		if i > 0 && tokens[i-1].kind == notToken {
+			return "", options, errQueryNotOption
+		}
+		switch {
+		case isSubmissionType(faapi.SubmissionType(t.text)):
+			types[faapi.SubmissionType(t.text)] = true
+		case isRating(faapi.Rating(t.text)):
+			ratings[faapi.Rating(t.text)] = true
+		default:
+			return "", options, fmt.Errorf("#%s isn't an option. The options are %s", t.text,
+				strings.Join(searchOptionNames("#"), ", "))
+		}
+	}
+	// choosing all of them is the same as not choosing any
+	if len(types) < len(faapi.SubmissionTypes) {
+		for _, t := range faapi.SubmissionTypes {
+			if types[t] {
+				options.Types = append(options.Types, t)
+			}
+		}
+	}
+	if len(ratings) < len(faapi.Ratings) {
+		for _, r := range faapi.Ratings {
+			if ratings[r] {
+				options.Ratings = append(options.Ratings, r)
+			}
+		}
+	}
+
+	p := &queryParser{tokens: query}
+	root, err := p.parseGroup()
+	if err != nil {
+		return "", options, err
+	}
+	if p.pos < len(p.tokens) {
+		// the only thing that stops a group early is a )
+		return "", options, errQueryCloseParen
+	}
+	if len(root.nodes) == 0 {
+		return "", options, errQueryEmpty
+	}
+	// parentheses around a single thing are gone after this, so they don't count as a group by themselves
+	root.normalize()
+	if err = root.check(); err != nil {
+		return "", options, err
+	}
+	return root.items(), options, nil
+}
+
+// formatSearchOptions writes the options the way they are written after a search's query.
+func formatSearchOptions(options faapi.SearchOptions) string {
+	var s string
+	for _, t := range options.Types {
+		s += " #" + string(t)
+	}
+	for _, r := range options.Ratings {
+		s += " #" + string(r)
+	}
+	return s
+}
+
+// searchOptionNames lists the names of every option, with the prefix before each.
+func searchOptionNames(prefix string) []string {
+	var names []string
+	for _, t := range faapi.SubmissionTypes {
+		names = append(names, prefix+string(t))
+	}
+	for _, r := range faapi.Ratings {
+		names = append(names, prefix+string(r))
+	}
+	return names
+}
+
+func isSubmissionType(t faapi.SubmissionType) bool {
+	for _, known := range faapi.SubmissionTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenizeQuery splits a search into its words, phrases and operators, lower casing them.
+func tokenizeQuery(search string) ([]queryToken, error) {
+	// lower casing changes each rune by itself, so positions in one are the same in the other
+	original := []rune(search)
+	r := []rune(strings.ToLower(search))
+	var tokens []queryToken
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, queryToken{kind: openToken})
+			i++
+		case c == ')':
+			tokens = append(tokens, queryToken{kind: closeToken})
+			i++
+		case c == '|':
+			tokens = append(tokens, queryToken{kind: orToken})
+			i++
+		case c == '!' || c == '-':
+			// these only mean "not" at the start of a word, otherwise they're part of it
+			tokens = append(tokens, queryToken{kind: notToken})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(r) && r[end] != '"' {
+				end++
+			}
+			if end == len(r) {
+				return nil, errQueryUnclosed
+			}
+			phrase := strings.Join(strings.Fields(string(r[i+1:end])), " ")
+			if phrase == "" {
+				return nil, errQueryEmptyPhrase
+			}
+			i = end + 1
+			// proximity like "a b"~5 and quorum like "a b c"/2 stay attached to the phrase
+			if i+1 < len(r) && (r[i] == '~' || r[i] == '/') && unicode.IsDigit(r[i+1]) {
+				suffix := i + 1
+				for suffix < len(r) && unicode.IsDigit(r[suffix]) {
+					suffix++
+				}
+				phrase = `"` + phrase + `"` + string(r[i:suffix])
+				i = suffix
+			} else {
+				phrase = `"` + phrase + `"`
+			}
+			tokens = append(tokens, queryToken{kind: phraseToken, text: phrase})
+		case c == '#':
+			end := i + 1
+			for end < len(r) && !unicode.IsSpace(r[end]) && !strings.ContainsRune(`()|"@`, r[end]) {
+				end++
+			}
+			if end == i+1 {
+				return nil, errQueryOption
+			}
+			tokens = append(tokens, queryToken{kind: optionToken, text: string(r[i+1 : end])})
+			i = end
+		case c == '@':
+			end := i + 1
+			for end < len(r) && (unicode.IsLetter(r[end]) || unicode.IsDigit(r[end]) || r[end] == '_') {
+				end++
+			}
+			if end == i+1 {
+				return nil, errQueryField
+			}
+			if end < len(r) && r[end] == '[' {
+				return nil, unsupportedQueryError("@" + string(r[i+1:end]) + "[...]")
+			}
+			tokens = append(tokens, queryToken{kind: fieldToken, text: string(r[i+1 : end])})
+			i = end
+		default:
+			end := i
+			for end < len(r) && !unicode.IsSpace(r[end]) && !strings.ContainsRune(`()|"@`, r[end]) {
+				end++
+			}
+			if op := unsupportedQueryRegexp.FindString(string(original[i:end])); op != "" {
+				return nil, unsupportedQueryError(op)
+			}
+			tokens = append(tokens, queryToken{kind: wordToken, text: string(r[i:end])})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func unsupportedQueryError(op string) error {
+	return fmt.Errorf("it uses %s, which isn't supported in alerts", op)
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// parseGroup parses words that must all match, up to the end of the search or a ).
+func (p *queryParser) parseGroup() (*queryNode, error) {
+	group := &queryNode{kind: groupNode}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind == closeToken {
+			return group, nil
+		}
+		if t.kind == fieldToken {
+			p.pos++
+			group.nodes = append(group.nodes, &queryNode{kind: fieldNode, text: t.text})
+			continue
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		group.nodes = append(group.nodes, n)
+	}
+}
+
+// parseOr parses one or more alternatives separated by |, which binds tighter than the spaces between words.
+func (p *queryParser) parseOr() (*queryNode, error) {
+	t, _ := p.peek()
+	if t.kind == orToken {
+		return nil, errQueryOr
+	}
+	n, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	or := &queryNode{kind: orNode, nodes: []*queryNode{n}}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind != orToken {
+			break
+		}
+		p.pos++
+		t, ok = p.peek()
+		if !ok || t.kind == orToken || t.kind == closeToken || t.kind == fieldToken {
+			return nil, errQueryOr
+		}
+		n, err = p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		or.nodes = append(or.nodes, n)
+	}
+	if len(or.nodes) == 1 {
+		return or.nodes[0], nil
+	}
+	return or, nil
+}
+
+func (p *queryParser) parseNot() (*queryNode, error) {
+	t, _ := p.peek()
+	if t.kind != notToken {
+		return p.parsePrimary()
+	}
+	p.pos++
+	t, ok := p.peek()
+	if !ok || (t.kind != wordToken && t.kind != phraseToken && t.kind != openToken) {
+		return nil, errQueryNot
+	}
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return &queryNode{kind: notNode, nodes: []*queryNode{n}}, nil
+}
+
+func (p *queryParser) parsePrimary() (*queryNode, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, errQueryEmpty
+	}
+	p.pos++
+	switch t.kind {
+	case wordToken:
+		return &queryNode{kind: wordNode, text: t.text}, nil
+	case phraseToken:
+		return &queryNode{kind: phraseNode, text: t.text}, nil
+	case openToken:
+		group, err := p.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.kind != closeToken {
+			return nil, errQueryOpenParen
+		}
+		p.pos++
+		if len(group.nodes) == 0 {
+			return nil, errQueryEmptyParens
+		}
+		return group, nil
+	case closeToken:
+		return nil, errQueryCloseParen
+	default:
+		// parseOr and parseNot already turned away anything else
+		return nil, errQueryEmpty
+	}
+}
+
+// check makes sure that every group has something to find that isn't excluded, and that fields are followed by
+// something to find in them, which FurAffinity requires.
+func (n *queryNode) check() error {
+	positive := false
+	for i, c := range n.nodes {
+		if n.kind == groupNode && c.kind == fieldNode {
+			if i == len(n.nodes)-1 || n.nodes[i+1].kind == fieldNode {
+				return fmt.Errorf("@%s needs something to search for after it", c.text)
+			}
+			continue
+		}
+		if c.kind != notNode {
+			positive = true
+		}
+		if err := c.check(); err != nil {
+			return err
+		}
+	}
+	if n.kind == groupNode && !positive {
+		return errQueryOnlyExcluded
+	}
+	return nil
+}
+
+// normalize rewrites the node and everything in it into its canonical form.
+func (n *queryNode) normalize() {
+	for i, c := range n.nodes {
+		c.normalize()
+		// parentheses around a single thing don't do anything
+		if c.kind == groupNode && len(c.nodes) == 1 {
+			n.nodes[i] = c.nodes[0]
+		}
+	}
+
+	switch n.kind {
+	case orNode:
+		// (a | b) | c is the same as a | b | c
+		var alts []*queryNode
+		for _, c := range n.nodes {
+			if c.kind == orNode {
+				alts = append(alts, c.nodes...)
+			} else {
+				alts = append(alts, c)
+			}
+		}
+		n.nodes = sortQueryNodes(alts)
+		if len(n.nodes) == 1 {
+			*n = *n.nodes[0]
+		}
+	case groupNode:
+		// parentheses without fields in them don't change anything in a group of words that all have to match
+		var items []*queryNode
+		for _, c := range n.nodes {
+			if c.kind == groupNode && !c.hasFields() {
+				items = append(items, c.nodes...)
+			} else {
+				items = append(items, c)
+			}
+		}
+		// fields apply to everything after them, so only sort between them
+		n.nodes = nil
+		start := 0
+		for i := 0; i <= len(items); i++ {
+			if i == len(items) || items[i].kind == fieldNode {
+				n.nodes = append(n.nodes, sortQueryNodes(items[start:i])...)
+				if i < len(items) {
+					n.nodes = append(n.nodes, items[i])
+				}
+				start = i + 1
+			}
+		}
+	}
+}
+
+func (n *queryNode) hasFields() bool {
+	for _, c := range n.nodes {
+		if c.kind == fieldNode {
+			return true
+		}
+	}
+	return false
+}
+
+// sortQueryNodes sorts the nodes by how they are written, dropping duplicates.
+func sortQueryNodes(nodes []*queryNode) []*queryNode {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].String() < nodes[j].String()
+	})
+	var sorted []*queryNode
+	for i, n := range nodes {
+		if i == 0 || n.String() != nodes[i-1].String() {
+			sorted = append(sorted, n)
+		}
+	}
+	return sorted
+}
+
+// items writes a group's contents without the parentheses around them.
+func (n *queryNode) items() string {
+	parts := make([]string, len(n.nodes))
+	for i, c := range n.nodes {
+		parts[i] = c.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+func (n *queryNode) String() string {
+	switch n.kind {
+	case wordNode, phraseNode:
+		return n.text
+	case fieldNode:
+		return "@" + n.text
+	case notNode:
+		c := n.nodes[0]
+		if c.kind == orNode {
+			return "!(" + c.String() + ")"
+		}
+		return "!" + c.String()
+	case orNode:
+		parts := make([]string, len(n.nodes))
+		for i, c := range n.nodes {
+			parts[i] = c.String()
+		}
+		return strings.Join(parts, " | ")
+	default:
+		return "(" + n.items() + ")"
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ajanata/faapi"
+)
+
+func TestCanonicalSearch(t *testing.T) {
+	tests := []struct {
+		name   string
+		search string
+		want   string
+	}{
+		{"single word", "cat", "cat"},
+		{"lower cased", "Cat DOG", "cat dog"},
+		{"spaces collapsed", "  cat \t  dog  ", "cat dog"},
+		{"words sorted", "wolf cat dog", "cat dog wolf"},
+		{"duplicates dropped", "cat dog cat", "cat dog"},
+		{"minus becomes not", "cat -dog", "!dog cat"},
+		{"not kept", "cat !dog", "!dog cat"},
+		{"hyphen inside word", "cat-girl", "cat-girl"},
+		{"or alternatives sorted", "wolf | cat", "cat | wolf"},
+		{"or binds tighter than and", "fox wolf | cat", "cat | wolf fox"},
+		{"nested or flattened", "(c | b) | a", "a | b | c"},
+		{"parentheses around one thing dropped", "(cat) dog", "cat dog"},
+		{"parentheses in and flattened", "(wolf cat) dog", "cat dog wolf"},
+		{"parentheses around or kept", "dog (wolf | cat)", "cat | wolf dog"},
+		{"not of or", "dog !(wolf | cat)", "!(cat | wolf) dog"},
+		{"not of group", "dog -(wolf cat)", "!(cat wolf) dog"},
+		{"phrase kept whole", `"Red  Fox" cat`, `"red fox" cat`},
+		{"phrase proximity", `"red fox"~5 cat`, `"red fox"~5 cat`},
+		{"phrase quorum", `"red fox tail"/2`, `"red fox tail"/2`},
+		{"fields split sorting", "@title wolf cat @keywords fox dog", "@title cat wolf @keywords dog fox"},
+		{"words before a field sorted", "wolf cat @title fox", "cat wolf @title fox"},
+		{"parentheses with fields kept", "dog (@title wolf cat)", "(@title cat wolf) dog"},
+		{"wildcards kept", "cat* dog", "cat* dog"},
+		{"lower case keywords are words", "maybe near", "maybe near"},
+		{"not inside group", "(!a) b", "!a b"},
+		{"options at the end", "#art cat", "cat #art"},
+		{"options in order", "cat #General #story #ART", "cat #art #story #general"},
+		{"duplicate options dropped", "cat #art #art", "cat #art"},
+		{"every rating is no rating", "cat #adult #general #mature #art", "cat #art"},
+		{"every type is no type", "cat #art #flash #photo #music #story #poetry", "cat"},
+		{"hash inside word kept", "c# cat", "c# cat"},
+		{"hash inside phrase kept", `"#art cat"`, `"#art cat"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := canonicalSearch(test.search)
+			if err != nil {
+				t.Fatalf("canonicalSearch(%q) returned error: %s", test.search, err)
+			}
+			if got != test.want {
+				t.Errorf("canonicalSearch(%q) = %q, want %q", test.search, got, test.want)
+			}
+
+			again, err := canonicalSearch(got)
+			if err != nil {
+				t.Fatalf("canonicalSearch(%q) of its own result returned error: %s", got, err)
+			}
+			if again != got {
+				t.Errorf("canonicalSearch(%q) = %q, isn't the same as its input", got, again)
+			}
+		})
+	}
+}
+
+func TestCanonicalSearchEquivalent(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"cat dog", "dog cat"},
+		{"cat -dog", "!dog cat"},
+		{"a | b | c", "c | (b | a)"},
+		{"(a b) c", "c b a"},
+		{`"x y"  z`, `Z "X Y"`},
+		{"cat #art #general", "#general cat #art"},
+	}
+	for _, test := range tests {
+		a, err := canonicalSearch(test.a)
+		if err != nil {
+			t.Fatalf("canonicalSearch(%q) returned error: %s", test.a, err)
+		}
+		b, err := canonicalSearch(test.b)
+		if err != nil {
+			t.Fatalf("canonicalSearch(%q) returned error: %s", test.b, err)
+		}
+		if a != b {
+			t.Errorf("canonicalSearch(%q) = %q, but canonicalSearch(%q) = %q", test.a, a, test.b, b)
+		}
+	}
+}
+
+func TestCanonicalSearchRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		search string
+		err    string
+	}{
+		{"empty", "", errQueryEmpty.Error()},
+		{"only spaces", "   ", errQueryEmpty.Error()},
+		{"unclosed phrase", `"red fox`, errQueryUnclosed.Error()},
+		{"empty phrase", `cat ""`, errQueryEmptyPhrase.Error()},
+		{"field without name", "@ cat", errQueryField.Error()},
+		{"field list", "@(title,keywords) cat", errQueryField.Error()},
+		{"unclosed parentheses", "(cat dog", errQueryOpenParen.Error()},
+		{"unopened parentheses", "cat dog)", errQueryCloseParen.Error()},
+		{"empty parentheses", "cat ()", errQueryEmptyParens.Error()},
+		{"or at start", "| cat", errQueryOr.Error()},
+		{"or at end", "cat |", errQueryOr.Error()},
+		{"double or", "cat || dog", errQueryOr.Error()},
+		{"not without word", "cat !", errQueryNot.Error()},
+		{"only excluded", "!cat -dog", errQueryOnlyExcluded.Error()},
+		{"only excluded in alternative", "dog | (!cat !fox)", errQueryOnlyExcluded.Error()},
+		{"field at end", "cat @title", "@title needs something to search for after it"},
+		{"strict order", "cat << dog", "it uses <<, which isn't supported in alerts"},
+		{"strict order in word", "cat<<dog", "it uses <<, which isn't supported in alerts"},
+		{"near", "cat NEAR/3 dog", "it uses NEAR/3, which isn't supported in alerts"},
+		{"sentence", "cat SENTENCE dog", "it uses SENTENCE, which isn't supported in alerts"},
+		{"paragraph", "cat PARAGRAPH dog", "it uses PARAGRAPH, which isn't supported in alerts"},
+		{"maybe", "cat MAYBE dog", "it uses MAYBE, which isn't supported in alerts"},
+		{"zone", "ZONE:(h1) cat", "it uses ZONE:, which isn't supported in alerts"},
+		{"ampersand", "cat & dog", "it uses &, which isn't supported in alerts"},
+		{"field position limit", "@title[50] cat", "it uses @title[...], which isn't supported in alerts"},
+		{"option without name", "cat #", errQueryOption.Error()},
+		{"only options", "#art #general", errQueryEmpty.Error()},
+		{"excluded option", "cat !#art", errQueryNotOption.Error()},
+		{"unknown option", "cat #sculpture",
+			"#sculpture isn't an option. The options are #art, #flash, #photo, #music, #story, #poetry, #general, " +
+				"#mature, #adult"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := canonicalSearch(test.search)
+			if err == nil {
+				t.Fatalf("canonicalSearch(%q) = %q, want error %q", test.search, got, test.err)
+			}
+			if err.Error() != test.err {
+				t.Errorf("canonicalSearch(%q) returned error %q, want %q", test.search, err, test.err)
+			}
+		})
+	}
+}
+
+func TestSplitSearch(t *testing.T) {
+	tests := []struct {
+		name    string
+		search  string
+		query   string
+		types   []faapi.SubmissionType
+		ratings []faapi.Rating
+	}{
+		{"no options", "cat dog", "cat dog", nil, nil},
+		{"types", "cat #art #story", "cat", []faapi.SubmissionType{faapi.TypeArt, faapi.TypeStory}, nil},
+		{"ratings", "cat #general", "cat", nil, []faapi.Rating{faapi.RatingGeneral}},
+		{"both", "cat dog #music #mature #adult", "cat dog", []faapi.SubmissionType{faapi.TypeMusic},
+			[]faapi.Rating{faapi.RatingMature, faapi.RatingAdult}},
+		{"saved before searches were checked", "cat #sculpture (", "cat #sculpture (", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, options := splitSearch(test.search)
+			if query != test.query {
+				t.Errorf("splitSearch(%q) query = %q, want %q", test.search, query, test.query)
+			}
+			if fmt.Sprint(options.Types) != fmt.Sprint(test.types) {
+				t.Errorf("splitSearch(%q) types = %v, want %v", test.search, options.Types, test.types)
+			}
+			if fmt.Sprint(options.Ratings) != fmt.Sprint(test.ratings) {
+				t.Errorf("splitSearch(%q) ratings = %v, want %v", test.search, options.Ratings, test.ratings)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ajanata/fanotify/db"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	quietHoursUsageMsg = `Send <code>/quiethours</code> with when you don't want to be disturbed and your time zone, like <code>/quiethours 23:00-07:00 Europe/Berlin</code>. Alerts found during quiet hours are sent when they end.
+
+Add <code>summary</code> to get held alerts together in one message instead of one at a time, or <code>separate</code> to go back.
+
+Send <code>/quiethours off</code> to turn them off. Time zones are named like in the <a href="https://en.wikipedia.org/wiki/List_of_tz_database_time_zones">tz database</a>, and default to UTC.`
+
+	summaryHeader          = "<b>Here's what I found while your alerts were held:</b>"
+	summaryContinuedHeader = "<b>Here's more of what I found while your alerts were held:</b>"
+	// Telegram's limit is 4096 characters after the HTML is parsed, so this leaves some room for the header.
+	maxSummaryLength = 4000
+)
+
+var (
+	quietHoursRegexp = regexp.MustCompile(`^\d{1,2}:\d{2}-\d{1,2}:\d{2}$`)
+)
+
+// quietHoursEnd returns when the quiet hours that t is in end, if t is in the user's quiet hours.
+func quietHoursEnd(user *db.TGUser, t time.Time) (time.Time, bool) {
+	q := user.QuietHours
+	if q == nil || q.Start == q.End {
+		return time.Time{}, false
+	}
+
+	lt := t.In(user.Location())
+	minute := lt.Hour()*60 + lt.Minute()
+	endDay := lt.Day()
+	if q.Start < q.End {
+		if minute < q.Start || minute >= q.End {
+			return time.Time{}, false
+		}
+	} else {
+		// the window wraps around midnight
+		if minute < q.Start && minute >= q.End {
+			return time.Time{}, false
+		}
+		if minute >= q.Start {
+			endDay++
+		}
+	}
+	end := time.Date(lt.Year(), lt.Month(), endDay, q.End/60, q.End%60, 0, 0, lt.Location())
+	if end.Hour()*60+end.Minute() != q.End {
+		// the end is in the hour skipped when the clocks go forward, so it's read with the offset from before then
+		name, offset := lt.Zone()
+		end = time.Date(lt.Year(), lt.Month(), endDay, q.End/60, q.End%60, 0, 0, time.FixedZone(name, offset))
+		end = end.In(lt.Location())
+	}
+	return end, true
+}
+
+// releaseTime is when alerts held for the user should be sent, given their current snooze and quiet hours. It is now
+// if they shouldn't be held.
+func releaseTime(user *db.TGUser, now time.Time) time.Time {
+	at := now
+	if user.Snoozed(now) && user.SnoozeHold {
+		at = user.SnoozedUntil
+	}
+	if end, quiet := quietHoursEnd(user, at); quiet {
+		at = end
+	}
+	return at
+}
+
+func formatMinutes(m int) string {
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+// cmdQuietHours configures when the user doesn't want to be disturbed. Each argument changes one thing, so they can be
+// given in any order, and anything not given is left alone.
+func (b *bot) cmdQuietHours(u *tgbotapi.User, args string) {
+	logger := log.WithFields(log.Fields{
+		"func":     "cmdQuietHours",
+		"userID":   u.ID,
+		"username": u.UserName,
+		"args":     args,
+	})
+
+	if !b.userStartedBot(u.ID) {
+		return
+	}
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		b.quietHoursStatus(u)
+		return
+	}
+
+	var (
+		off, summary, separate bool
+		window                 *db.QuietHours
+		timezone               string
+	)
+	for _, f := range fields {
+		switch lower := strings.ToLower(f); {
+		case lower == "off":
+			off = true
+		case lower == "summary":
+			summary = true
+		case lower == "separate":
+			separate = true
+		case quietHoursRegexp.MatchString(f):
+			var err error
+			window, err = parseQuietHours(f)
+			if err != nil {
+				b.sendHTMLMessage(u.ID, "I don't understand the quiet hours <code>%s</code>.\n\n%s", escapeHTML(f),
+					quietHoursUsageMsg)
+				return
+			}
+		default:
+			if _, err := time.LoadLocation(f); err != nil || f == "Local" {
+				b.sendHTMLMessage(u.ID, "I don't know the time zone <code>%s</code>.\n\n%s", escapeHTML(f),
+					quietHoursUsageMsg)
+				return
+			}
+			timezone = f
+		}
+	}
+	if window != nil && window.Start == window.End {
+		b.sendHTMLMessage(u.ID, "Quiet hours have to start and end at different times.")
+		return
+	}
+
+	var release time.Time
+	now := time.Now()
+	err := b.db.UpdateTGUser(db.TelegramID(u.ID), func(user *db.TGUser) error {
+		if timezone != "" {
+			user.Timezone = timezone
+		}
+		if window != nil {
+			if user.QuietHours != nil {
+				window.Summary = user.QuietHours.Summary
+			}
+			user.QuietHours = window
+		}
+		if user.QuietHours != nil && (summary || separate) {
+			user.QuietHours.Summary = summary
+		}
+		if off {
+			user.QuietHours = nil
+		}
+		release = releaseTime(user, now)
+		return nil
+	})
+	if err == nil {
+		// anything already held follows the new quiet hours
+		err = b.db.RescheduleHeldNotifications(db.TelegramID(u.ID), release)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Unable to save quiet hours")
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "quiet hours change"))
+		return
+	}
+
+	b.quietHoursStatus(u)
+	// in case that released anything
+	b.wakeSender()
+}
+
+// parseQuietHours parses a window like "23:00-07:00".
+func parseQuietHours(s string) (*db.QuietHours, error) {
+	parts := strings.SplitN(s, "-", 2)
+	start, err := time.Parse("15:04", parts[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := time.Parse("15:04", parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &db.QuietHours{
+		Start: start.Hour()*60 + start.Minute(),
+		End:   end.Hour()*60 + end.Minute(),
+	}, nil
+}
+
+func (b *bot) quietHoursStatus(u *tgbotapi.User) {
+	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
+	if err != nil || user == nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":   "quietHoursStatus",
+			"userID": u.ID,
+		}).Error("Could not load user")
+		b.sendMessage(u.ID, loadFailedFormat, "your quiet hours")
+		return
+	}
+
+	loc := user.Location()
+	if user.QuietHours == nil {
+		b.sendHTMLMessage(u.ID, "You don't have quiet hours set. Your time zone is %s.\n\n%s", loc, quietHoursUsageMsg)
+		return
+	}
+
+	how := "one at a time"
+	if user.QuietHours.Summary {
+		how = "together in one message"
+	}
+	b.sendHTMLMessage(u.ID, "Your quiet hours are from %s to %s, %s time. Alerts found then are sent %s when they end.",
+		formatMinutes(user.QuietHours.Start), formatMinutes(user.QuietHours.End), loc, how)
+}
+
+// collapseNotifications replaces the user's due collapsed alerts with summaries, which are then sent like any other
+// alert. Returns false if the sender should stop for now.
+func (b *bot) collapseNotifications(userID db.TelegramID, logger *log.Entry) bool {
+	err := b.db.CollapseNotifications(userID, time.Now(), summarizeNotifications)
+	if err != nil {
+		logger.WithError(err).WithField("userID", userID).Error("Unable to collapse held alerts")
+		return false
+	}
+	return true
+}
+
+// summarizeNotifications puts the text of the notifications into as few messages as fit, in the order they were found.
+func summarizeNotifications(ns []*db.Notification) []*db.Notification {
+	var summaries []*db.Notification
+	var text string
+	for _, n := range ns {
+		if text != "" && len(text)+len(n.Text)+2 > maxSummaryLength {
+			summaries = append(summaries, &db.Notification{UserID: n.UserID, Text: text})
+			text = ""
+		}
+		if text == "" {
+			if len(summaries) == 0 {
+				text = summaryHeader
+			} else {
+				text = summaryContinuedHeader
+			}
+		}
+		text += "\n\n" + n.Text
+	}
+	return append(summaries, &db.Notification{UserID: ns[0].UserID, Text: text})
+}
@@ -0,0 +1,274 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+	// the tests need real time zones even where the system doesn't have them
+	_ "time/tzdata"
+
+	"github.com/ajanata/fanotify/db"
+)
+
+// localTime is a wall clock time in the named time zone.
+func localTime(t *testing.T, zone string, year int, month time.Month, day, hour, min int) time.Time {
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		t.Fatalf("Unable to load time zone %s: %v", zone, err)
+	}
+	return time.Date(year, month, day, hour, min, 0, 0, loc)
+}
+
+func TestQuietHoursEnd(t *testing.T) {
+	const (
+		utc     = "UTC"
+		tokyo   = "Etc/GMT-9"
+		newYork = "America/New_York"
+		berlin  = "Europe/Berlin"
+	)
+	tests := []struct {
+		name string
+		zone string
+		// quiet hours as minutes after midnight, nil for none
+		quiet *db.QuietHours
+		t     time.Time
+		want  time.Time
+		// wantQuiet is whether t is in quiet hours
+		wantQuiet bool
+	}{
+		{
+			name: "no quiet hours",
+			zone: utc,
+			t:    localTime(t, utc, 2026, 5, 1, 12, 0),
+		},
+		{
+			name:  "empty window",
+			zone:  utc,
+			quiet: &db.QuietHours{Start: 9 * 60, End: 9 * 60},
+			t:     localTime(t, utc, 2026, 5, 1, 9, 0),
+		},
+		{
+			name:      "inside a daytime window",
+			zone:      utc,
+			quiet:     &db.QuietHours{Start: 9 * 60, End: 17 * 60},
+			t:         localTime(t, utc, 2026, 5, 1, 12, 0),
+			want:      localTime(t, utc, 2026, 5, 1, 17, 0),
+			wantQuiet: true,
+		},
+		{
+			name:      "window starts at its start",
+			zone:      utc,
+			quiet:     &db.QuietHours{Start: 9 * 60, End: 17 * 60},
+			t:         localTime(t, utc, 2026, 5, 1, 9, 0),
+			want:      localTime(t, utc, 2026, 5, 1, 17, 0),
+			wantQuiet: true,
+		},
+		{
+			name:  "window is over at its end",
+			zone:  utc,
+			quiet: &db.QuietHours{Start: 9 * 60, End: 17 * 60},
+			t:     localTime(t, utc, 2026, 5, 1, 17, 0),
+		},
+		{
+			name:      "before midnight in a window crossing it",
+			zone:      utc,
+			quiet:     &db.QuietHours{Start: 23 * 60, End: 7 * 60},
+			t:         localTime(t, utc, 2026, 5, 1, 23, 30),
+			want:      localTime(t, utc, 2026, 5, 2, 7, 0),
+			wantQuiet: true,
+		},
+		{
+			name:      "after midnight in a window crossing it",
+			zone:      utc,
+			quiet:     &db.QuietHours{Start: 23 * 60, End: 7 * 60},
+			t:         localTime(t, utc, 2026, 5, 2, 3, 0),
+			want:      localTime(t, utc, 2026, 5, 2, 7, 0),
+			wantQuiet: true,
+		},
+		{
+			name:  "outside a window crossing midnight",
+			zone:  utc,
+			quiet: &db.QuietHours{Start: 23 * 60, End: 7 * 60},
+			t:     localTime(t, utc, 2026, 5, 2, 12, 0),
+		},
+		{
+			name:      "window crossing the end of the month",
+			zone:      utc,
+			quiet:     &db.QuietHours{Start: 23 * 60, End: 7 * 60},
+			t:         localTime(t, utc, 2026, 1, 31, 23, 30),
+			want:      localTime(t, utc, 2026, 2, 1, 7, 0),
+			wantQuiet: true,
+		},
+		{
+			name:  "window is in the user's time zone",
+			zone:  tokyo,
+			quiet: &db.QuietHours{Start: 22 * 60, End: 6 * 60},
+			// 23:00 in Tokyo
+			t:         localTime(t, utc, 2026, 6, 1, 14, 0),
+			want:      localTime(t, tokyo, 2026, 6, 2, 6, 0),
+			wantQuiet: true,
+		},
+		{
+			name:  "outside the window in the user's time zone",
+			zone:  tokyo,
+			quiet: &db.QuietHours{Start: 22 * 60, End: 6 * 60},
+			// 22:00 in UTC, but 07:00 in Tokyo
+			t: localTime(t, utc, 2026, 6, 1, 22, 0),
+		},
+		{
+			name:  "summer time",
+			zone:  berlin,
+			quiet: &db.QuietHours{Start: 0, End: 8 * 60},
+			// 01:30 in Berlin
+			t:         localTime(t, utc, 2026, 7, 1, 23, 30),
+			want:      localTime(t, berlin, 2026, 7, 2, 8, 0),
+			wantQuiet: true,
+		},
+		{
+			name:      "clocks go back during the window",
+			zone:      newYork,
+			quiet:     &db.QuietHours{Start: 22 * 60, End: 7 * 60},
+			t:         localTime(t, newYork, 2026, 10, 31, 23, 0),
+			want:      localTime(t, newYork, 2026, 11, 1, 7, 0),
+			wantQuiet: true,
+		},
+		{
+			name:      "clocks go forward during the window",
+			zone:      newYork,
+			quiet:     &db.QuietHours{Start: 22 * 60, End: 7 * 60},
+			t:         localTime(t, newYork, 2026, 3, 7, 23, 0),
+			want:      localTime(t, newYork, 2026, 3, 8, 7, 0),
+			wantQuiet: true,
+		},
+		{
+			name:  "window ends in the skipped hour",
+			zone:  newYork,
+			quiet: &db.QuietHours{Start: 60, End: 2*60 + 30},
+			t:     localTime(t, newYork, 2026, 3, 8, 1, 45),
+			// 02:30 doesn't happen that night, so it ends an hour after it would have
+			want:      localTime(t, newYork, 2026, 3, 8, 3, 30),
+			wantQuiet: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := &db.TGUser{
+				Timezone:   test.zone,
+				QuietHours: test.quiet,
+			}
+			got, quiet := quietHoursEnd(user, test.t)
+			if quiet != test.wantQuiet {
+				t.Fatalf("quietHoursEnd(%s) quiet = %t, want %t", test.t, quiet, test.wantQuiet)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("quietHoursEnd(%s) = %s, want %s", test.t, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReleaseTime(t *testing.T) {
+	const zone = "America/New_York"
+	night := &db.QuietHours{Start: 23 * 60, End: 7 * 60}
+	noon := localTime(t, zone, 2026, 5, 1, 12, 0)
+	tests := []struct {
+		name       string
+		quiet      *db.QuietHours
+		snoozed    time.Time
+		snoozeHold bool
+		now        time.Time
+		want       time.Time
+	}{
+		{
+			name:  "not held",
+			quiet: night,
+			now:   noon,
+			want:  noon,
+		},
+		{
+			name:  "quiet hours",
+			quiet: night,
+			now:   localTime(t, zone, 2026, 5, 1, 23, 30),
+			want:  localTime(t, zone, 2026, 5, 2, 7, 0),
+		},
+		{
+			name:       "held snooze",
+			quiet:      night,
+			snoozed:    localTime(t, zone, 2026, 5, 1, 15, 0),
+			snoozeHold: true,
+			now:        noon,
+			want:       localTime(t, zone, 2026, 5, 1, 15, 0),
+		},
+		{
+			name:       "held snooze ending in quiet hours",
+			quiet:      night,
+			snoozed:    localTime(t, zone, 2026, 5, 2, 1, 0),
+			snoozeHold: true,
+			now:        noon,
+			want:       localTime(t, zone, 2026, 5, 2, 7, 0),
+		},
+		{
+			name:       "held snooze ending in quiet hours after the clocks go back",
+			quiet:      night,
+			snoozed:    localTime(t, zone, 2026, 11, 1, 1, 0),
+			snoozeHold: true,
+			now:        localTime(t, zone, 2026, 10, 31, 12, 0),
+			want:       localTime(t, zone, 2026, 11, 1, 7, 0),
+		},
+		{
+			name:    "snooze that drops alerts",
+			quiet:   night,
+			snoozed: localTime(t, zone, 2026, 5, 1, 15, 0),
+			now:     noon,
+			want:    noon,
+		},
+		{
+			name:       "snooze that has run out",
+			quiet:      night,
+			snoozed:    localTime(t, zone, 2026, 5, 1, 11, 0),
+			snoozeHold: true,
+			now:        noon,
+			want:       noon,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := &db.TGUser{
+				Timezone:     zone,
+				QuietHours:   test.quiet,
+				SnoozedUntil: test.snoozed,
+				SnoozeHold:   test.snoozeHold,
+			}
+			if got := releaseTime(user, test.now); !got.Equal(test.want) {
+				t.Errorf("releaseTime(%s) = %s, want %s", test.now, got, test.want)
+			}
+		})
+	}
+}
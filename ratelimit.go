@@ -0,0 +1,157 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// chatBucketSweepInterval is how often idle per-chat buckets are thrown away.
+	chatBucketSweepInterval = time.Minute
+)
+
+type (
+	// tokenBucket allows rate events per second on average, with bursts of up to burst events. Tokens are reserved
+	// ahead of time, so callers wait in line instead of being turned away.
+	tokenBucket struct {
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+
+	// sendLimiter keeps us within Telegram's flood limits, both overall and for each chat, by making senders wait
+	// their turn.
+	sendLimiter struct {
+		mutex     sync.Mutex
+		global    *tokenBucket
+		chats     map[int]*tokenBucket
+		chatRate  float64
+		chatBurst float64
+		lastSweep time.Time
+	}
+)
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// reserve takes a token from the bucket and returns how long to wait before it may be used.
+func (tb *tokenBucket) reserve(now time.Time) time.Duration {
+	if tb.rate <= 0 {
+		// unlimited
+		return 0
+	}
+
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// idle checks whether the bucket would be full by now, in which case it's no different from a new one.
+func (tb *tokenBucket) idle(now time.Time) bool {
+	return tb.rate <= 0 || tb.tokens+now.Sub(tb.last).Seconds()*tb.rate >= tb.burst
+}
+
+func newSendLimiter(c *TG) *sendLimiter {
+	now := time.Now()
+	return &sendLimiter{
+		global:    newTokenBucket(c.GlobalSendRate, c.GlobalSendBurst, now),
+		chats:     make(map[int]*tokenBucket),
+		chatRate:  c.ChatSendRate,
+		chatBurst: float64(c.ChatSendBurst),
+		lastSweep: now,
+	}
+}
+
+// ready checks whether a message could be sent to the chat right now without waiting for its limit. It doesn't take a
+// token, so that the sender can pass over chats that would make it wait.
+func (l *sendLimiter) ready(chatID int) bool {
+	return l.readyAt(chatID, time.Now())
+}
+
+func (l *sendLimiter) readyAt(chatID int, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	tb := l.chats[chatID]
+	return tb == nil || tb.rate <= 0 || tb.tokens+now.Sub(tb.last).Seconds()*tb.rate >= 1
+}
+
+// wait blocks until a message may be sent to the chat.
+func (l *sendLimiter) wait(chatID int) {
+	time.Sleep(l.reserveChat(chatID, time.Now()))
+	time.Sleep(l.reserveGlobal(time.Now()))
+}
+
+func (l *sendLimiter) reserveChat(chatID int, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastSweep) > chatBucketSweepInterval {
+		for id, tb := range l.chats {
+			if tb.idle(now) {
+				delete(l.chats, id)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	tb := l.chats[chatID]
+	if tb == nil {
+		tb = newTokenBucket(l.chatRate, int(l.chatBurst), now)
+		l.chats[chatID] = tb
+	}
+	return tb.reserve(now)
+}
+
+func (l *sendLimiter) reserveGlobal(now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.global.reserve(now)
+}
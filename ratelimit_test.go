@@ -0,0 +1,197 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		// at is when each token is reserved, after the bucket was made
+		at   []time.Duration
+		want []time.Duration
+	}{
+		{
+			name:  "burst then wait",
+			rate:  1,
+			burst: 2,
+			at:    []time.Duration{0, 0, 0, 0},
+			want:  []time.Duration{0, 0, time.Second, 2 * time.Second},
+		},
+		{
+			name:  "refill",
+			rate:  2,
+			burst: 1,
+			at:    []time.Duration{0, 500 * time.Millisecond, 500 * time.Millisecond},
+			want:  []time.Duration{0, 0, 500 * time.Millisecond},
+		},
+		{
+			name:  "refill stops at burst",
+			rate:  1,
+			burst: 2,
+			at:    []time.Duration{0, 0, time.Minute, time.Minute, time.Minute},
+			want:  []time.Duration{0, 0, 0, 0, time.Second},
+		},
+		{
+			name:  "waiting in line",
+			rate:  1,
+			burst: 1,
+			at:    []time.Duration{0, 0, 500 * time.Millisecond},
+			want:  []time.Duration{0, time.Second, 1500 * time.Millisecond},
+		},
+		{
+			name:  "burst is at least one",
+			rate:  1,
+			burst: 0,
+			at:    []time.Duration{0, 0},
+			want:  []time.Duration{0, time.Second},
+		},
+		{
+			name:  "unlimited",
+			rate:  0,
+			burst: 1,
+			at:    []time.Duration{0, 0, 0},
+			want:  []time.Duration{0, 0, 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			tb := newTokenBucket(test.rate, test.burst, start)
+			for i, at := range test.at {
+				if got := tb.reserve(start.Add(at)); got != test.want[i] {
+					t.Errorf("reservation %d at %s waits %s, want %s", i, at, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+type limiterStep struct {
+	chat int
+	at   time.Duration
+	// ready is what ready says before the reservation
+	ready      bool
+	chatWait   time.Duration
+	globalWait time.Duration
+}
+
+func TestSendLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		c     TG
+		steps []limiterStep
+	}{
+		{
+			name: "each chat has its own limit",
+			c:    TG{ChatSendRate: 1, ChatSendBurst: 1, GlobalSendRate: 10, GlobalSendBurst: 10},
+			steps: []limiterStep{
+				{chat: 1, at: 0, ready: true},
+				{chat: 1, at: 0, ready: false, chatWait: time.Second},
+				{chat: 2, at: 0, ready: true},
+				{chat: 1, at: 2 * time.Second, ready: true},
+			},
+		},
+		{
+			name: "global limit applies across chats",
+			c:    TG{ChatSendRate: 1, ChatSendBurst: 1, GlobalSendRate: 1, GlobalSendBurst: 2},
+			steps: []limiterStep{
+				{chat: 1, at: 0, ready: true},
+				{chat: 2, at: 0, ready: true},
+				// the chat is ready, but everything waits for the global limit
+				{chat: 3, at: 0, ready: true, globalWait: time.Second},
+				{chat: 4, at: time.Second, ready: true, globalWait: time.Second},
+			},
+		},
+		{
+			name: "chat limit is stricter than global",
+			c:    TG{ChatSendRate: 0.5, ChatSendBurst: 2, GlobalSendRate: 30, GlobalSendBurst: 30},
+			steps: []limiterStep{
+				{chat: 1, at: 0, ready: true},
+				{chat: 1, at: 0, ready: true},
+				{chat: 1, at: 0, ready: false, chatWait: 2 * time.Second},
+				{chat: 1, at: time.Second, ready: false, chatWait: 3 * time.Second},
+			},
+		},
+		{
+			name: "unlimited chats are always ready",
+			c:    TG{GlobalSendRate: 1, GlobalSendBurst: 1},
+			steps: []limiterStep{
+				{chat: 1, at: 0, ready: true},
+				{chat: 1, at: 0, ready: true, globalWait: time.Second},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			l := newSendLimiter(&test.c)
+			l.global = newTokenBucket(test.c.GlobalSendRate, test.c.GlobalSendBurst, start)
+			l.lastSweep = start
+			for i, step := range test.steps {
+				now := start.Add(step.at)
+				if got := l.readyAt(step.chat, now); got != step.ready {
+					t.Errorf("step %d: chat %d ready = %t, want %t", i, step.chat, got, step.ready)
+				}
+				if got := l.reserveChat(step.chat, now); got != step.chatWait {
+					t.Errorf("step %d: chat %d waits %s for its own limit, want %s", i, step.chat, got,
+						step.chatWait)
+				}
+				if got := l.reserveGlobal(now); got != step.globalWait {
+					t.Errorf("step %d: chat %d waits %s for the global limit, want %s", i, step.chat, got,
+						step.globalWait)
+				}
+			}
+		})
+	}
+}
+
+func TestSendLimiterReadyDoesNotReserve(t *testing.T) {
+	start := time.Now()
+	l := newSendLimiter(&TG{ChatSendRate: 1, ChatSendBurst: 1})
+	l.reserveChat(1, start)
+
+	for i := 0; i < 3; i++ {
+		if l.readyAt(1, start) {
+			t.Fatalf("chat is ready right after using its only token")
+		}
+	}
+	if !l.readyAt(1, start.Add(time.Second)) {
+		t.Fatalf("chat isn't ready after its token came back")
+	}
+	// checking didn't use the token that came back, so there's no wait for it
+	if got := l.reserveChat(1, start.Add(time.Second)); got != 0 {
+		t.Errorf("reserving after ready waits %s, want 0", got)
+	}
+}
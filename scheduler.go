@@ -0,0 +1,285 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// schedulerResolution is how often the scheduler checks for jobs that are due.
+	schedulerResolution = 5 * time.Second
+)
+
+type (
+	jobType int
+
+	// job identifies a single search or furaffinity user to poll.
+	job struct {
+		jobType jobType
+		key     string
+	}
+
+	// scheduler tracks when each search and furaffinity user is next due to be polled, and runs them on a bounded pool
+	// of workers. The workers all use the same faapi client, so they share its rate limit.
+	scheduler struct {
+		b        *bot
+		interval time.Duration
+		workers  int
+		jobs     chan job
+		wg       sync.WaitGroup
+
+		mutex   sync.Mutex
+		due     map[job]time.Time
+		running map[job]bool
+		// lag is how far past its due time the most overdue job was the last time jobs were dispatched.
+		lag    time.Duration
+		behind bool
+		// lastSuccess is when a job last finished without failing.
+		lastSuccess time.Time
+	}
+)
+
+const (
+	searchJob jobType = iota
+	faUserJob
+)
+
+func newScheduler(b *bot, interval time.Duration, workers int) *scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &scheduler{
+		b:        b,
+		interval: interval,
+		workers:  workers,
+		jobs:     make(chan job, workers),
+		due:      make(map[job]time.Time),
+		running:  make(map[job]bool),
+	}
+}
+
+func (jt jobType) String() string {
+	switch jt {
+	case searchJob:
+		return "search"
+	case faUserJob:
+		return "faUser"
+	default:
+		return "unknown"
+	}
+}
+
+// run dispatches jobs as they come due until quit is closed, then waits for any running jobs to finish.
+func (s *scheduler) run(quit <-chan struct{}) {
+	for i := 0; i < s.workers; i++ {
+		s.wg.Add(1)
+		go s.worker(quit)
+	}
+
+	ticker := time.NewTicker(schedulerResolution)
+	defer ticker.Stop()
+
+	s.dispatch()
+	for {
+		select {
+		case <-quit:
+			log.Info("stopping scheduler, waiting for running jobs to finish")
+			close(s.jobs)
+			s.wg.Wait()
+			return
+		case <-ticker.C:
+			s.dispatch()
+		}
+	}
+}
+
+// dispatch hands due jobs to idle workers, most overdue first.
+func (s *scheduler) dispatch() {
+	logger := log.WithField("func", "dispatch")
+
+	err := s.sync()
+	if err != nil {
+		logger.WithError(err).Error("Unable to load jobs")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	var ready []job
+	for j, due := range s.due {
+		if !s.running[j] && !due.After(now) {
+			ready = append(ready, j)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		return s.due[ready[i]].Before(s.due[ready[j]])
+	})
+
+	s.lag = 0
+	if len(ready) > 0 {
+		s.lag = now.Sub(s.due[ready[0]])
+	}
+	s.reportLag(len(ready))
+
+	idle := s.workers - len(s.running)
+	for i := 0; i < len(ready) && i < idle; i++ {
+		s.running[ready[i]] = true
+		// the channel has room for every worker, so this won't block
+		s.jobs <- ready[i]
+	}
+}
+
+// reportLag logs when the scheduler starts falling behind by more than a poll interval, and when it catches back up.
+// Must be called with the mutex held.
+func (s *scheduler) reportLag(waiting int) {
+	logger := log.WithFields(log.Fields{
+		"func":    "reportLag",
+		"lag":     s.lag,
+		"waiting": waiting,
+	})
+
+	if s.lag > s.interval {
+		if !s.behind {
+			logger.Warn("Polling is falling behind, consider a longer poll interval or more workers")
+			s.behind = true
+		}
+	} else if s.behind {
+		logger.Info("Polling has caught up")
+		s.behind = false
+	}
+}
+
+// sync adds any searches and furaffinity users that are new since the last sync, and removes any that were deleted.
+// New items are first due one interval after they were last run, or when they are next to be retried if they are
+// failing.
+func (s *scheduler) sync() error {
+	searches, err := s.b.db.GetSearches()
+	if err != nil {
+		return err
+	}
+	faUsers, err := s.b.db.GetFAUsers()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	present := make(map[job]bool, len(searches)+len(faUsers))
+	for _, search := range searches {
+		j := job{jobType: searchJob, key: search.Search}
+		present[j] = true
+		if _, exists := s.due[j]; !exists {
+			s.due[j] = s.nextDue(search.LastRun, search.NextRetry)
+		}
+	}
+	for _, faUser := range faUsers {
+		j := job{jobType: faUserJob, key: faUser.Username}
+		present[j] = true
+		if _, exists := s.due[j]; !exists {
+			s.due[j] = s.nextDue(faUser.LastRun, faUser.NextRetry)
+		}
+	}
+
+	for j := range s.due {
+		if !present[j] {
+			delete(s.due, j)
+		}
+	}
+	return nil
+}
+
+// worker runs jobs until the jobs channel is closed. Once quit is closed, jobs that are still waiting for a worker are
+// skipped, but a job that is already running gets to finish and save its progress.
+func (s *scheduler) worker(quit <-chan struct{}) {
+	defer logPanic()
+	defer s.wg.Done()
+
+	for j := range s.jobs {
+		select {
+		case <-quit:
+			continue
+		default:
+		}
+
+		start := time.Now()
+		log.WithFields(log.Fields{
+			"type": j.jobType,
+			"key":  j.key,
+		}).Debug("Running job")
+
+		var retry time.Time
+		switch j.jobType {
+		case searchJob:
+			retry = s.b.doSearch(j.key)
+		case faUserJob:
+			retry = s.b.doUserMonitoring(j.key)
+		}
+
+		s.mutex.Lock()
+		delete(s.running, j)
+		s.due[j] = s.nextDue(start, retry)
+		// jobs only have a retry time while they are failing
+		if retry.IsZero() {
+			s.lastSuccess = time.Now()
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// nextDue is when an item should next run: one interval after lastRun, unless it is backing off for longer.
+func (s *scheduler) nextDue(lastRun, retry time.Time) time.Time {
+	due := lastRun.Add(s.interval)
+	if retry.After(due) {
+		return retry
+	}
+	return due
+}
+
+// jobStatus returns when the job is next due, and whether it is running now. If the scheduler doesn't know about the job
+// yet, due is zero.
+func (s *scheduler) jobStatus(j job) (due time.Time, running bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.due[j], s.running[j]
+}
+
+// health returns when a job last succeeded, and how far behind polling was the last time jobs were dispatched.
+func (s *scheduler) health() (lastSuccess time.Time, lag time.Duration, behind bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastSuccess, s.lag, s.behind
+}
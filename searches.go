@@ -30,17 +30,49 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/ajanata/faapi"
 	"github.com/ajanata/fanotify/db"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	addSearchMsg = `Send me a message with the search you wish to perform, exactly how you would enter it in FurAffinity's search box.
+	addSearchMsg = `Send me a message with the search you wish to perform, exactly how you would enter it in FurAffinity's search box. I'll ask which types and ratings of submission it should find next.
 
 Or, you can send /cancel to cancel adding a search alert.`
 
+	searchOptionsFormat = `Which kinds of submission should <code>%s</code> find? Send any of the types %s, and any of the ratings %s, like <code>art story general</code>. Leaving out every type or every rating finds all of them, so send <code>all</code> to find everything.
+
+You can also write them after a search with a #, like <code>/addsearch cute fox #art #general</code>.
+
+Or, you can send /cancel to cancel adding a search alert.`
+
+	noSearchesMsg    = "You don't have any searches saved. Send /addsearch to get started!"
+	listSearchSuffix = "\n\nTap a button below to pause, filter or remove one, or send /delsearch to remove one."
+
+	testSearchMsg = `Send me a message with the search you want to try, exactly how you would enter it in FurAffinity's search box. You can narrow it down to types and ratings of submission after it with a #, like #art or #general. I'll show you what it finds right now, without saving it.
+
+Or, you can send /cancel to cancel testing a search.`
+
+	// testSearchResults is how many results /testsearch shows.
+	testSearchResults = 10
+
+	editSearchMsgSuffix = `
+
+Please send the search to change, exactly as it appears above.
+
+Or, you can send /cancel to cancel editing a search alert.`
+
+	editSearchToFormat = `What should <code>%s</code> be changed to? Send it exactly how you would enter it in FurAffinity's search box, with any types or ratings after it like <code>#art #general</code>.
+
+Or, you can send /cancel to cancel editing a search alert.`
+
+	invalidSearchFormat = `I can't use <code>%s</code> as a search, because %s.
+
+Please check it against <a href="https://www.furaffinity.net/help/#search">FurAffinity's search syntax</a> and try again.`
+
 	delSearchMsgSuffix = `
 
 Please send the search to delete, exactly as it appears above.
@@ -48,32 +80,101 @@ Please send the search to delete, exactly as it appears above.
 Or, you can send /cancel to cancel deleting a search alert.`
 )
 
-func (b *bot) cmdAddSearch(u *tgbotapi.User) {
+// cmdAddSearch adds the search given as the command's arguments, or asks for the search if there weren't any.
+func (b *bot) cmdAddSearch(u *tgbotapi.User, args string) {
 	if !b.userStartedBot(u.ID) {
 		return
 	}
 
+	if args != "" {
+		b.addSearch(u, args)
+		return
+	}
+
 	b.plaintextHandler[u.ID] = b.addSearchCallback
 	b.sendMessage(u.ID, addSearchMsg)
 }
 
+// addSearchCallback checks the search, and asks which types and ratings it should find if it doesn't say.
 func (b *bot) addSearchCallback(m *tgbotapi.Message) {
+	search, ok := b.parseSearch(m.From, m.Text)
+	if !ok {
+		return
+	}
+	if _, options := splitSearch(search); len(options.Types) > 0 || len(options.Ratings) > 0 {
+		b.addSearch(m.From, search)
+		return
+	}
+	b.askSearchOptions(m.From.ID, search)
+}
+
+// askSearchOptions asks which types and ratings the search should find, and adds it with them.
+func (b *bot) askSearchOptions(userID int, search string) {
+	b.plaintextHandler[userID] = func(m *tgbotapi.Message) {
+		b.addSearchOptions(m.From, search, m.Text)
+	}
+	types := make([]string, len(faapi.SubmissionTypes))
+	for i, t := range faapi.SubmissionTypes {
+		types[i] = string(t)
+	}
+	ratings := make([]string, len(faapi.Ratings))
+	for i, r := range faapi.Ratings {
+		ratings[i] = string(r)
+	}
+	b.sendHTMLMessage(userID, searchOptionsFormat, escapeHTML("%s", search), strings.Join(types, ", "),
+		strings.Join(ratings, ", "))
+}
+
+// addSearchOptions adds the search, narrowed down by the types and ratings the user chose for it.
+func (b *bot) addSearchOptions(u *tgbotapi.User, search, options string) {
+	fields := strings.Fields(strings.ToLower(options))
+	if len(fields) == 0 {
+		b.askSearchOptions(u.ID, search)
+		return
+	}
+	if len(fields) == 1 && fields[0] == "all" {
+		b.addSearch(u, search)
+		return
+	}
+
+	known := make(map[string]bool)
+	for _, name := range searchOptionNames("") {
+		known[name] = true
+	}
+	for i, f := range fields {
+		fields[i] = strings.TrimPrefix(f, "#")
+		if !known[fields[i]] {
+			b.sendHTMLMessage(u.ID, "I don't know the type or rating <code>%s</code>.", escapeHTML("%s", f))
+			b.askSearchOptions(u.ID, search)
+			return
+		}
+	}
+	b.addSearch(u, search+" #"+strings.Join(fields, " #"))
+}
+
+func (b *bot) addSearch(u *tgbotapi.User, search string) {
 	logger := log.WithFields(log.Fields{
-		"func":     "addSearchCallback",
-		"userID":   m.From.ID,
-		"username": m.From.UserName,
+		"func":     "addSearch",
+		"userID":   u.ID,
+		"username": u.UserName,
 	})
 
-	err := b.db.AddSearchForUser(db.TelegramID(m.From.ID), m.Text)
+	search, ok := b.parseSearch(u, search)
+	if !ok {
+		return
+	}
+
+	err := b.db.AddSearchForUser(db.TelegramID(u.ID), search)
 	if err != nil {
 		logger.WithError(err).Error("Unable to add search for user")
-		b.sendMessage(m.From.ID, fmt.Sprintf(saveFailedFormat, "search alert"))
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "search alert"))
 	} else {
-		b.sendHTMLMessage(m.From.ID, "I will alert you to any new submissions that match <code>%s</code> now.", m.Text)
+		b.sendAdded(u.ID, searchSubscription, search,
+			fmt.Sprintf("I will alert you to any new submissions that match <code>%s</code> now.", escapeHTML(search)))
 	}
 }
 
-func (b *bot) getSearchesToSend(u *tgbotapi.User) string {
+func (b *bot) getSearchesToSend(u *tgbotapi.User) (string, []string) {
 	logger := log.WithFields(log.Fields{
 		"func":     "getSearchesToSend",
 		"userID":   u.ID,
@@ -81,39 +182,50 @@ func (b *bot) getSearchesToSend(u *tgbotapi.User) string {
 	})
 
 	if !b.userStartedBot(u.ID) {
-		return ""
+		return "", nil
 	}
 
 	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
 	if err != nil {
 		logger.WithError(err).Error("Could not load user")
 		b.sendMessage(u.ID, loadFailedFormat, "your saved searches")
-		return ""
+		return "", nil
 	}
 
 	if len(user.Searches) == 0 {
-		b.sendMessage(u.ID, "You don't have any searches saved. Send /addsearch to get started!")
-		return ""
+		b.sendMessage(u.ID, noSearchesMsg)
+		return "", nil
 	}
 
+	msg, searches := searchList(user)
+	return msg, searches
+}
+
+// searchList formats the user's saved searches, returning the searches in the order they are listed.
+func searchList(user *db.TGUser) (string, []string) {
+	searches := sortedKeys(user.Searches)
 	msg := "You have the following searches saved:"
-	for s := range user.Searches {
-		msg = fmt.Sprintf("%s\n<code>%s</code>", msg, s)
+	for _, s := range searches {
+		msg = fmt.Sprintf("%s\n<code>%s</code>%s", msg, escapeHTML(s), settingsSuffix(user, searchSubscription, s))
 	}
-	return msg
+	return msg, searches
 }
 
 func (b *bot) cmdListSearch(u *tgbotapi.User) {
-	msg := b.getSearchesToSend(u)
-	if msg == "" {
+	b.sendSubscriptionList(u, searchSubscription)
+}
+
+// cmdDelSearch deletes the search given as the command's arguments, or lists the user's searches and asks which to
+// delete if there weren't any.
+func (b *bot) cmdDelSearch(u *tgbotapi.User, args string) {
+	if args != "" {
+		if b.userStartedBot(u.ID) {
+			b.delSearch(u, args)
+		}
 		return
 	}
-	msg = msg + "\n\nSend /delsearch to remove one."
-	b.sendHTMLMessage(u.ID, msg)
-}
 
-func (b *bot) cmdDelSearch(u *tgbotapi.User) {
-	msg := b.getSearchesToSend(u)
+	msg, _ := b.getSearchesToSend(u)
 	if msg == "" {
 		return
 	}
@@ -123,20 +235,211 @@ func (b *bot) cmdDelSearch(u *tgbotapi.User) {
 }
 
 func (b *bot) delSearchCallback(m *tgbotapi.Message) {
+	b.delSearch(m.From, m.Text)
+}
+
+func (b *bot) delSearch(u *tgbotapi.User, search string) {
 	logger := log.WithFields(log.Fields{
-		"func":     "delSearchCallback",
-		"userID":   m.From.ID,
-		"username": m.From.UserName,
+		"func":     "delSearch",
+		"userID":   u.ID,
+		"username": u.UserName,
 	})
 
-	err := b.db.DeleteSearchForUser(db.TelegramID(m.From.ID), m.Text)
+	search = searchKey(search)
+	err := b.db.DeleteSearchForUser(db.TelegramID(u.ID), search)
 	switch err {
 	case db.ErrNoSearch:
-		b.sendMessage(m.From.ID, "I couldn't find that search.")
+		b.sendMessage(u.ID, "I couldn't find that search.")
 	case nil:
-		b.sendHTMLMessage(m.From.ID, "I will no longer alert you to any new submissions that match <code>%s</code>.", m.Text)
+		b.sendHTMLMessage(u.ID, "I will no longer alert you to any new submissions that match <code>%s</code>.",
+			escapeHTML(search))
 	default:
 		logger.WithError(err).Error("Unable to delete search for user")
-		b.sendMessage(m.From.ID, fmt.Sprintf(saveFailedFormat, "search alert deletion"))
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "search alert deletion"))
+	}
+}
+
+// cmdTestSearch runs the search given as the command's arguments, or asks for the search if there weren't any.
+func (b *bot) cmdTestSearch(u *tgbotapi.User, args string) {
+	if !b.userStartedBot(u.ID) {
+		return
+	}
+
+	if args != "" {
+		b.runInBackground(func() { b.testSearch(u, args) })
+		return
+	}
+
+	b.plaintextHandler[u.ID] = b.testSearchCallback
+	b.sendMessage(u.ID, testSearchMsg)
+}
+
+func (b *bot) testSearchCallback(m *tgbotapi.Message) {
+	b.runInBackground(func() { b.testSearch(m.From, m.Text) })
+}
+
+// testSearch shows the user the top results for a search without saving it, with a button to add it. Searching can
+// take a while with FA's rate limit, so this is run in its own goroutine instead of holding up the update loop.
+func (b *bot) testSearch(u *tgbotapi.User, search string) {
+	defer logPanic()
+	logger := log.WithFields(log.Fields{
+		"func":     "testSearch",
+		"userID":   u.ID,
+		"username": u.UserName,
+		"search":   search,
+	})
+
+	search, ok := b.parseSearch(u, search)
+	if !ok {
+		return
+	}
+	b.sendHTMLMessage(u.ID, "Searching FurAffinity for <code>%s</code>...", escapeHTML(search))
+	query, options := splitSearch(search)
+	subs, err := b.fa.NewSearchWithOptions(query, options).GetPage(1)
+	if err != nil {
+		logger.WithError(err).Warn("Unable to run test search")
+		b.sendMessage(u.ID, "Sorry, I couldn't reach FurAffinity to run that search. Please try again later.")
+		return
+	}
+
+	var msg string
+	if len(subs) == 0 {
+		msg = fmt.Sprintf("Nothing matches <code>%s</code> right now. Check the search syntax, or it may just be rare.",
+			escapeHTML(search))
+	} else {
+		msg = fmt.Sprintf("The newest submissions matching <code>%s</code> are:\n", escapeHTML(search))
+		for i, sub := range subs {
+			if i >= testSearchResults {
+				break
+			}
+			msg = fmt.Sprintf("%s\n%d. <a href=\"https://www.furaffinity.net/view/%d/\">%s</a> by %s (%s)",
+				msg, i+1, sub.ID, escapeHTML(sub.Title), escapeHTML(sub.User), sub.Rating)
+		}
+	}
+	msg += "\n\nThis search has not been saved."
+
+	b.setPendingTestSearch(u.ID, search)
+	m := tgbotapi.NewMessage(int64(u.ID), msg)
+	m.ParseMode = "HTML"
+	m.DisableWebPagePreview = true
+	m.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Add this search",
+			b.callbackData(callbackAdd, u.ID, searchSubscription, search)),
+	))
+	b.send(u.ID, m)
+}
+
+// setPendingTestSearch remembers the user's most recent test search, so that it can be added from its button.
+func (b *bot) setPendingTestSearch(userID int, search string) {
+	b.pendingTestSearchesMutex.Lock()
+	defer b.pendingTestSearchesMutex.Unlock()
+	b.pendingTestSearches[userID] = search
+}
+
+// pendingTestSearch returns the user's most recent test search as a set, to match against callback tokens.
+func (b *bot) pendingTestSearch(userID int) map[string]bool {
+	b.pendingTestSearchesMutex.Lock()
+	defer b.pendingTestSearchesMutex.Unlock()
+	search, exists := b.pendingTestSearches[userID]
+	if !exists {
+		return nil
+	}
+	return map[string]bool{search: true}
+}
+
+// cmdEditSearch changes one of the user's searches without losing its place. The search to change can be given as the
+// command's arguments, otherwise the user's searches are listed and they are asked which to change.
+func (b *bot) cmdEditSearch(u *tgbotapi.User, args string) {
+	if args != "" {
+		if b.userStartedBot(u.ID) {
+			b.editSearchFrom(u, args)
+		}
+		return
+	}
+
+	msg, _ := b.getSearchesToSend(u)
+	if msg == "" {
+		return
+	}
+
+	b.plaintextHandler[u.ID] = b.editSearchCallback
+	b.sendHTMLMessage(u.ID, msg+editSearchMsgSuffix)
+}
+
+func (b *bot) editSearchCallback(m *tgbotapi.Message) {
+	b.editSearchFrom(m.From, m.Text)
+}
+
+// editSearchFrom checks that the user has the search, and asks what to change it to.
+func (b *bot) editSearchFrom(u *tgbotapi.User, from string) {
+	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
+	if err != nil || user == nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":   "editSearchFrom",
+			"userID": u.ID,
+		}).Error("Could not load user")
+		b.sendMessage(u.ID, loadFailedFormat, "your saved searches")
+		return
+	}
+	from = searchKey(from)
+	if !user.Searches[from] {
+		b.sendMessage(u.ID, "I couldn't find that search.")
+		return
+	}
+
+	b.plaintextHandler[u.ID] = func(m *tgbotapi.Message) {
+		b.editSearch(m.From, from, m.Text)
+	}
+	b.sendHTMLMessage(u.ID, editSearchToFormat, escapeHTML("%s", from))
+}
+
+func (b *bot) editSearch(u *tgbotapi.User, from, to string) {
+	logger := log.WithFields(log.Fields{
+		"func":     "editSearch",
+		"userID":   u.ID,
+		"username": u.UserName,
+		"from":     from,
+		"to":       to,
+	})
+
+	to, ok := b.parseSearch(u, to)
+	if !ok {
+		return
+	}
+
+	err := b.db.EditSearchForUser(db.TelegramID(u.ID), from, to)
+	switch err {
+	case db.ErrNoSearch:
+		b.sendMessage(u.ID, "I couldn't find that search.")
+	case nil:
+		b.sendHTMLMessage(u.ID, "I changed <code>%s</code> to <code>%s</code>. Anything posted since it last ran "+
+			"that matches the new search will still be sent.", escapeHTML("%s", from), escapeHTML("%s", to))
+	default:
+		logger.WithError(err).Error("Unable to edit search for user")
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "search alert change"))
+	}
+}
+
+// parseSearch checks the search, returning its canonical form. If it isn't valid, the user is told why and ok is false.
+func (b *bot) parseSearch(u *tgbotapi.User, search string) (string, bool) {
+	canonical, err := canonicalSearch(search)
+	if err != nil {
+		m := tgbotapi.NewMessage(int64(u.ID), fmt.Sprintf(invalidSearchFormat, escapeHTML("%s", search),
+			escapeHTML("%s", err.Error())))
+		m.ParseMode = "HTML"
+		m.DisableWebPagePreview = true
+		b.send(u.ID, m)
+		return "", false
+	}
+	return canonical, true
+}
+
+// searchKey returns how a search the user already has is saved. That's its canonical form, unless it can't be parsed,
+// in which case it was saved before searches were checked and was kept as it was.
+func searchKey(search string) string {
+	canonical, err := canonicalSearch(search)
+	if err != nil {
+		return search
 	}
+	return canonical
 }
@@ -29,8 +29,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/ajanata/fanotify/db"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
@@ -45,6 +49,9 @@ import (
 // we were doing this for.
 var blockedUsers = map[int]bool{}
 
+// blockedUsersMutex guards blockedUsers, since messages are sent from multiple poll workers.
+var blockedUsersMutex sync.Mutex
+
 // userStartedBot checks that the user has started (and hasn't stopped) the bot.
 func (b *bot) userStartedBot(userID int) bool {
 	logger := log.WithFields(log.Fields{
@@ -85,47 +92,145 @@ func escapeHTML(s string, params ...interface{}) string {
 	return html
 }
 
+// send queues the message to be sent to the user in the background, after anything else already queued for them. The
+// rate limit can make sending wait, and that shouldn't hold up whatever is replying, like the update loop.
 func (b *bot) send(userID int, m tgbotapi.Chattable) {
-	if blockedUsers[userID] {
-		return
+	b.repliesMutex.Lock()
+	defer b.repliesMutex.Unlock()
+
+	pending, sending := b.replies[userID]
+	b.replies[userID] = append(pending, m)
+	if !sending {
+		go b.replySender(userID)
+	}
+}
+
+// replySender sends the user's queued replies in order, until there aren't any left.
+func (b *bot) replySender(userID int) {
+	defer logPanic()
+
+	for {
+		b.repliesMutex.Lock()
+		pending := b.replies[userID]
+		if len(pending) == 0 {
+			delete(b.replies, userID)
+			b.repliesMutex.Unlock()
+			return
+		}
+		m := pending[0]
+		b.replies[userID] = pending[1:]
+		b.repliesMutex.Unlock()
+
+		b.sendNow(userID, m)
+	}
+}
+
+// repliesPending checks whether any replies are still waiting to be sent.
+func (b *bot) repliesPending() bool {
+	b.repliesMutex.Lock()
+	defer b.repliesMutex.Unlock()
+	return len(b.replies) > 0
+}
+
+func (b *bot) sendNow(userID int, m tgbotapi.Chattable) {
+	err := b.deliver(userID, m)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"func":    "sendNow",
+			"userID":  userID,
+			"message": m,
+		}).Error("Unable to send message")
+	}
+}
+
+// deliver sends the message to the user, returning any error from Telegram. If the user has blocked the bot or has not
+// started it, nothing is sent and no error is returned.
+func (b *bot) deliver(userID int, m tgbotapi.Chattable) error {
+	blockedUsersMutex.Lock()
+	blocked := blockedUsers[userID]
+	blockedUsersMutex.Unlock()
+	if blocked {
+		return nil
 	}
-	logger := log.WithFields(log.Fields{
-		"func":    "send",
-		"userID":  userID,
-		"message": m,
-	})
 
 	if !b.userStartedBot(userID) {
-		return
+		return nil
 	}
 
-	_, err := b.tg.Send(m)
+	b.sendLimiter.wait(userID)
+	var err error
+	if mg, ok := m.(tgbotapi.MediaGroupConfig); ok {
+		err = b.sendMediaGroup(mg)
+	} else {
+		_, err = b.tg.Send(m)
+	}
+	// TODO better way to check this
+	if err != nil && strings.Contains(err.Error(), "bot was blocked") {
+		blockedUsersMutex.Lock()
+		blockedUsers[userID] = true
+		blockedUsersMutex.Unlock()
+		log.WithFields(log.Fields{
+			"func":   "deliver",
+			"userID": userID,
+		}).Info("bot was blocked by user, not sending them anything else")
+		return nil
+	}
+	return err
+}
+
+// sendMediaGroup sends an album. The library can send them, but it expects a single message back instead of the list
+// of messages Telegram replies with, so it always reports an error.
+func (b *bot) sendMediaGroup(mg tgbotapi.MediaGroupConfig) error {
+	media, err := json.Marshal(mg.InputMedia)
 	if err != nil {
-		// TODO better way to check this
-		if strings.Contains(err.Error(), "bot was blocked") {
-			blockedUsers[userID] = true
-			logger.Info("bot was blocked by user, not sending them anything else")
-		} else {
-			logger.WithError(err).Error("Unable to send message")
-		}
+		return err
 	}
+
+	v := url.Values{}
+	v.Add("chat_id", strconv.FormatInt(mg.ChatID, 10))
+	v.Add("media", string(media))
+	_, err = b.tg.MakeRequest("sendMediaGroup", v)
+	return err
 }
 
-// tryToSendImage will send an image message if fb is non-nil, with msg as its HTML caption.
-// Otherwise, it will just send msg as a regular HTML message.
-func (b *bot) tryToSendImage(userID int, fb *tgbotapi.FileBytes, msg string) {
-	if fb != nil {
-		m := tgbotapi.NewPhotoUpload(int64(userID), *fb)
-		// media uploads have a 200 character limit
-		if len(msg) > 200 {
-			msg = msg[:200]
+// notificationMessage makes the message for a notification. It will be an image message if the notification has a
+// photo, with the text as its HTML caption. Albums are sent as a group of photos. Otherwise, it will just be a regular
+// HTML message.
+func notificationMessage(n *db.Notification) tgbotapi.Chattable {
+	if len(n.Album) == 1 {
+		// albums have to have at least two photos
+		m := tgbotapi.NewPhotoShare(int64(n.UserID), n.Album[0].URL)
+		m.Caption = n.Album[0].Caption
+		m.ParseMode = "HTML"
+		return m
+	}
+	if len(n.Album) > 1 {
+		media := make([]interface{}, len(n.Album))
+		for i, photo := range n.Album {
+			p := tgbotapi.NewInputMediaPhoto(photo.URL)
+			p.Caption = photo.Caption
+			p.ParseMode = "HTML"
+			media[i] = p
 		}
-		m.Caption = msg
+		return tgbotapi.NewMediaGroup(int64(n.UserID), media)
+	}
+
+	if n.Photo != nil {
+		m := tgbotapi.NewPhotoUpload(int64(n.UserID), tgbotapi.FileBytes{
+			Name:  n.PhotoName,
+			Bytes: n.Photo,
+		})
+		// media uploads have a length limit
+		m.Caption = cropMarkup(n.Text, maxCaptionLength)
 		m.ParseMode = "HTML"
-		b.send(userID, m)
-	} else {
-		b.sendHTMLMessage(userID, msg)
+		m.ReplyMarkup = blockKeyboard(n.Artist)
+		return m
 	}
+
+	m := tgbotapi.NewMessage(int64(n.UserID), n.Text)
+	m.ParseMode = "HTML"
+	m.ReplyMarkup = blockKeyboard(n.Artist)
+	return m
 }
 
 // alwaysSendMessage always sends a message to the user, even if they haven't started the bot.
@@ -137,6 +242,7 @@ func (b *bot) alwaysSendMessage(userID int, msg string) {
 	})
 
 	m := tgbotapi.NewMessage(int64(userID), msg)
+	b.sendLimiter.wait(userID)
 	_, err := b.tg.Send(m)
 	if err != nil {
 		logger.WithError(err).Error("Unable to send message")
@@ -0,0 +1,227 @@
+/*
+ *
+ * Copyright (c) 2018, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ * * Neither the name of the copyright holder nor the names of its contributors may be used to
+ *   endorse or promote products derived from this software without specific prior written
+ *   permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ajanata/fanotify/db"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+)
+
+// cmdStatus tells the user whether each of their alerts is working, and how the bot is doing overall.
+func (b *bot) cmdStatus(u *tgbotapi.User) {
+	logger := log.WithFields(log.Fields{
+		"func":     "cmdStatus",
+		"userID":   u.ID,
+		"username": u.UserName,
+	})
+
+	if !b.userStartedBot(u.ID) {
+		return
+	}
+
+	user, err := b.db.GetTGUser(db.TelegramID(u.ID))
+	if err != nil || user == nil {
+		logger.WithError(err).Error("Could not load user")
+		b.sendMessage(u.ID, loadFailedFormat, "your saved alerts")
+		return
+	}
+
+	now := time.Now()
+	sections := []string{b.healthStatus(user, now)}
+
+	for _, search := range sortedKeys(user.Searches) {
+		s, err := b.db.GetSearch(search)
+		if err != nil {
+			logger.WithError(err).Error("Unable to load search")
+			continue
+		}
+		title := fmt.Sprintf("<b>Search</b> <code>%s</code>%s", escapeHTML("%s", search),
+			settingsSuffix(user, searchSubscription, search))
+		if s == nil {
+			sections = append(sections, title+"\nNot checked yet.")
+			continue
+		}
+		newest := ""
+		if s.LastID > 0 {
+			newest = fmt.Sprintf("https://www.furaffinity.net/view/%d/", s.LastID)
+		}
+		sections = append(sections, title+"\n"+b.pollStatus(job{jobType: searchJob, key: search}, s.LastRun,
+			&s.FailureState, newest, now))
+	}
+
+	faUsers := make(map[string]bool, len(user.SubmissionUsers)+len(user.JournalUsers))
+	for faUser := range user.SubmissionUsers {
+		faUsers[faUser] = true
+	}
+	for faUser := range user.JournalUsers {
+		faUsers[faUser] = true
+	}
+	for _, username := range sortedKeys(faUsers) {
+		fa, err := b.db.GetFAUser(username)
+		if err != nil {
+			logger.WithError(err).Error("Unable to load furaffinity user")
+			continue
+		}
+		var which []string
+		if user.SubmissionUsers[username] {
+			which = append(which, "submissions"+settingsSuffix(user, submissionsSubscription, username))
+		}
+		if user.JournalUsers[username] {
+			which = append(which, "journals"+settingsSuffix(user, journalsSubscription, username))
+		}
+		title := fmt.Sprintf("<b>%s</b> (%s)", escapeHTML("%s", b.faUserName(username)), strings.Join(which, ", "))
+		if fa == nil {
+			sections = append(sections, title+"\nNot checked yet.")
+			continue
+		}
+		var newest []string
+		if fa.LastSubmissionID > 0 {
+			newest = append(newest, fmt.Sprintf("https://www.furaffinity.net/view/%d/", fa.LastSubmissionID))
+		}
+		if fa.LastJournalID > 0 {
+			newest = append(newest, fmt.Sprintf("https://www.furaffinity.net/journal/%d/", fa.LastJournalID))
+		}
+		sections = append(sections, title+"\n"+b.pollStatus(job{jobType: faUserJob, key: username}, fa.LastRun,
+			&fa.FailureState, strings.Join(newest, "\n"), now))
+	}
+
+	if len(sections) == 1 {
+		sections = append(sections, "You don't have any alerts saved. Send /help to see how to add some.")
+	}
+
+	// keep each message within Telegram's length limit
+	msg := ""
+	for _, section := range sections {
+		if msg != "" && len(msg)+len(section)+2 > maxSummaryLength {
+			b.sendStatus(u.ID, msg)
+			msg = ""
+		}
+		if msg != "" {
+			msg += "\n\n"
+		}
+		msg += section
+	}
+	b.sendStatus(u.ID, msg)
+}
+
+func (b *bot) sendStatus(userID int, msg string) {
+	m := tgbotapi.NewMessage(int64(userID), msg)
+	m.ParseMode = "HTML"
+	m.DisableWebPagePreview = true
+	b.send(userID, m)
+}
+
+// healthStatus describes how the bot as a whole is doing, and anything about the user that affects all of their
+// alerts.
+func (b *bot) healthStatus(user *db.TGUser, now time.Time) string {
+	lines := []string{"<b>Bot status</b>"}
+
+	lastSuccess, lag, behind := b.scheduler.health()
+	if lastSuccess.IsZero() {
+		lines = append(lines, "Nothing has been checked successfully since the bot started.")
+	} else {
+		lines = append(lines, "Last successful check: "+formatAgo(now, lastSuccess)+".")
+	}
+	if behind {
+		lines = append(lines, "Checks are running "+formatDuration(lag)+" behind schedule.")
+	}
+
+	queued, err := b.db.OutboxLength()
+	if err != nil {
+		log.WithError(err).WithField("func", "healthStatus").Error("Unable to count outbox")
+	} else {
+		lines = append(lines, fmt.Sprintf("Alerts waiting to be sent to everyone: %d.", queued))
+	}
+
+	if user.Snoozed(now) {
+		lines = append(lines, "Your alerts are snoozed until "+
+			user.SnoozedUntil.In(user.Location()).Format(snoozeTimeFormat)+".")
+	}
+	if user.DeliveryMode != db.DeliverImmediately {
+		lines = append(lines, fmt.Sprintf("You get your alerts in a %s digest.", user.DeliveryMode))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// pollStatus describes how checking one search or furaffinity user is going.
+func (b *bot) pollStatus(j job, lastRun time.Time, fs *db.FailureState, newest string, now time.Time) string {
+	var lines []string
+
+	// new items start with a last run at the epoch
+	if lastRun.Unix() <= 0 {
+		lines = append(lines, "Not checked successfully yet.")
+	} else {
+		lines = append(lines, "Last checked "+formatAgo(now, lastRun)+".")
+	}
+
+	due, running := b.scheduler.jobStatus(j)
+	switch {
+	case running:
+		lines = append(lines, "Being checked now.")
+	case due.IsZero():
+		lines = append(lines, "Will be checked soon.")
+	case !due.After(now):
+		lines = append(lines, "Waiting to be checked.")
+	default:
+		lines = append(lines, "Next check in "+formatDuration(due.Sub(now))+".")
+	}
+
+	if newest != "" {
+		lines = append(lines, "Newest: "+newest)
+	}
+
+	if fs.ConsecutiveFailures > 0 {
+		lines = append(lines, fmt.Sprintf("Failed the last %d times, most recently %s: %s", fs.ConsecutiveFailures,
+			formatAgo(now, fs.LastFailure), escapeHTML("%s", fs.LastError)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatAgo(now, t time.Time) string {
+	return formatDuration(now.Sub(t)) + " ago"
+}
+
+// formatDuration formats a duration roughly, since nobody needs to know the seconds of something that was hours ago.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
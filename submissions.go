@@ -30,7 +30,10 @@ package main
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 
+	"github.com/ajanata/faapi"
 	"github.com/ajanata/fanotify/db"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	log "github.com/sirupsen/logrus"
@@ -41,6 +44,11 @@ const (
 
 Or, you can send /cancel to cancel adding a submission alert.`
 
+	faUserNotFoundFormat = `I couldn't find <code>%s</code> on FurAffinity. Please check the spelling.`
+	faLookupFailedMsg    = "Sorry, I couldn't reach FurAffinity to check that user. Please try again later."
+
+	listSubmissionsSuffix = "\n\nTap a button below to pause, filter or remove one, or send /delsubmissions to remove one."
+
 	delSubmissionsMsgSuffix = `
 
 Please send the username you no longer wish to monitor for new submission.
@@ -48,34 +56,111 @@ Please send the username you no longer wish to monitor for new submission.
 Or, you can send /cancel to cancel deleting a submission alert.`
 )
 
-func (b *bot) cmdAddSubmissions(u *tgbotapi.User) {
+// cmdAddSubmissions adds the user given as the command's arguments, or asks for the user if there weren't any.
+func (b *bot) cmdAddSubmissions(u *tgbotapi.User, args string) {
 	if !b.userStartedBot(u.ID) {
 		return
 	}
 
+	if args != "" {
+		b.runInBackground(func() { b.addSubmissions(u, args) })
+		return
+	}
+
 	b.plaintextHandler[u.ID] = b.addSubmissionsCallback
 	b.sendMessage(u.ID, addSubmissionsMsg)
 }
 
 func (b *bot) addSubmissionsCallback(m *tgbotapi.Message) {
+	b.runInBackground(func() { b.addSubmissions(m.From, m.Text) })
+}
+
+// addSubmissions checks that the user exists on FurAffinity before saving the alert. That can take a while with FA's rate
+// limit, so this is run in its own goroutine instead of holding up the update loop.
+func (b *bot) addSubmissions(u *tgbotapi.User, faUser string) {
+	defer logPanic()
 	logger := log.WithFields(log.Fields{
-		"func":     "addSubmissionsCallback",
-		"userID":   m.From.ID,
-		"username": m.From.UserName,
+		"func":     "addSubmissions",
+		"userID":   u.ID,
+		"username": u.UserName,
 	})
 
-	// TODO make sure it's a valid fa username
+	name, ok := b.lookupFAUser(u, faUser)
+	if !ok {
+		return
+	}
 
-	err := b.db.AddUserSubmissionsForUser(db.TelegramID(m.From.ID), m.Text)
+	err := b.db.AddUserSubmissionsForUser(db.TelegramID(u.ID), faUser, name)
 	if err != nil {
 		logger.WithError(err).Error("Unable to add submissions for user")
-		b.sendMessage(m.From.ID, fmt.Sprintf(saveFailedFormat, "user submission alert"))
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "user submission alert"))
 	} else {
-		b.sendHTMLMessage(m.From.ID, "I will alert you to any new submissions from <code>%s</code> now.", m.Text)
+		b.sendAdded(u.ID, submissionsSubscription, strings.ToLower(faUser),
+			fmt.Sprintf("I will alert you to any new submissions from <code>%s</code> now.", escapeHTML(b.faUserName(faUser))))
+	}
+}
+
+var (
+	// this doesn't try to match FA's rules exactly, it just keeps anything that would break the URL from being sent
+	faUsernameRegexp = regexp.MustCompile(`^[^\s/?#&%]+$`)
+)
+
+// lookupFAUser checks that the furaffinity user exists, returning their name in their preferred case, or "" if that
+// isn't known. If they can't be found, the telegram user is told so and ok is false.
+func (b *bot) lookupFAUser(u *tgbotapi.User, faUser string) (name string, ok bool) {
+	logger := log.WithFields(log.Fields{
+		"func":   "lookupFAUser",
+		"userID": u.ID,
+		"faUser": faUser,
+	})
+
+	if !faUsernameRegexp.MatchString(faUser) {
+		b.sendHTMLMessage(u.ID, faUserNotFoundFormat, escapeHTML(faUser))
+		return "", false
+	}
+
+	b.sendHTMLMessage(u.ID, "Looking up <code>%s</code> on FurAffinity...", escapeHTML(faUser))
+	name, found, err := b.findFAUser(faUser)
+	if err != nil {
+		logger.WithError(err).Warn("Unable to look up furaffinity user")
+		b.sendMessage(u.ID, faLookupFailedMsg)
+		return "", false
+	}
+	if !found {
+		b.sendHTMLMessage(u.ID, faUserNotFoundFormat, escapeHTML(faUser))
+		return "", false
+	}
+	return name, true
+}
+
+// findFAUser checks whether the furaffinity user exists, returning their name in their preferred case if we can find
+// it out, or "" if not.
+func (b *bot) findFAUser(faUser string) (name string, found bool, err error) {
+	subs, _, err := b.fa.NewUser(faUser).GetRecent()
+	if err == faapi.ErrUserNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
 	}
+
+	// only the submission data includes the name as the user likes it to be written
+	if len(subs) > 0 {
+		return subs[0].User, true, nil
+	}
+	return "", true, nil
 }
 
-func (b *bot) getMonitoredUsersToSend(u *tgbotapi.User, journals bool) string {
+// faUserName returns the furaffinity user's name in their preferred case, if we know it.
+func (b *bot) faUserName(faUser string) string {
+	fa, err := b.db.GetFAUser(faUser)
+	if err != nil || fa == nil {
+		return faUser
+	}
+	return fa.Name()
+}
+
+func (b *bot) getMonitoredUsersToSend(u *tgbotapi.User, journals bool) (string, []string) {
 	logger := log.WithFields(log.Fields{
 		"func":     "getMonitoredUsersToSend",
 		"userID":   u.ID,
@@ -83,7 +168,7 @@ func (b *bot) getMonitoredUsersToSend(u *tgbotapi.User, journals bool) string {
 	})
 
 	if !b.userStartedBot(u.ID) {
-		return ""
+		return "", nil
 	}
 
 	which := "submission"
@@ -96,39 +181,57 @@ func (b *bot) getMonitoredUsersToSend(u *tgbotapi.User, journals bool) string {
 		logger.WithError(err).Error("Could not load user")
 		b.sendMessage(u.ID, loadFailedFormat,
 			fmt.Sprintf("your saved user %s alerts", which))
-		return ""
+		return "", nil
 	}
 
-	if len(user.Searches) == 0 {
-		b.sendMessage(u.ID, "You don't have any user %s alerts saved. Send /add%s to get started!",
-			which, which)
-		return ""
+	msg, users := b.monitoredUserList(user, journals)
+	if len(users) == 0 {
+		b.sendMessage(u.ID, msg)
+		return "", nil
 	}
+	return msg, users
+}
 
-	msg := fmt.Sprintf("You have the following user %s alerts saved:", which)
-	var m map[string]bool
+// monitoredUserList formats the furaffinity users the user is monitoring for either submissions or journals,
+// returning the users in the order they are listed. If there aren't any, the message says so.
+func (b *bot) monitoredUserList(user *db.TGUser, journals bool) (string, []string) {
+	which := "submission"
+	m := user.SubmissionUsers
+	kind := submissionsSubscription
 	if journals {
+		which = "journal"
 		m = user.JournalUsers
-	} else {
-		m = user.SubmissionUsers
+		kind = journalsSubscription
 	}
-	for s := range m {
-		msg = fmt.Sprintf("%s\n<code>%s</code>", msg, s)
+
+	if len(m) == 0 {
+		return fmt.Sprintf("You don't have any user %s alerts saved. Send /add%ss to get started!", which, which),
+			nil
+	}
+
+	users := sortedKeys(m)
+	msg := fmt.Sprintf("You have the following user %s alerts saved:", which)
+	for _, s := range users {
+		msg = fmt.Sprintf("%s\n<code>%s</code>%s", msg, escapeHTML(b.faUserName(s)), settingsSuffix(user, kind, s))
 	}
-	return msg
+	return msg, users
 }
 
 func (b *bot) cmdListSubmissions(u *tgbotapi.User) {
-	msg := b.getMonitoredUsersToSend(u, false)
-	if msg == "" {
+	b.sendSubscriptionList(u, submissionsSubscription)
+}
+
+// cmdDelSubmissions deletes the user given as the command's arguments, or lists the monitored users and asks which to
+// delete if there weren't any.
+func (b *bot) cmdDelSubmissions(u *tgbotapi.User, args string) {
+	if args != "" {
+		if b.userStartedBot(u.ID) {
+			b.delSubmissions(u, args)
+		}
 		return
 	}
-	msg = msg + "\n\nSend /delsubmissions to remove one."
-	b.sendHTMLMessage(u.ID, msg)
-}
 
-func (b *bot) cmdDelSubmissions(u *tgbotapi.User) {
-	msg := b.getMonitoredUsersToSend(u, false)
+	msg, _ := b.getMonitoredUsersToSend(u, false)
 	if msg == "" {
 		return
 	}
@@ -138,20 +241,25 @@ func (b *bot) cmdDelSubmissions(u *tgbotapi.User) {
 }
 
 func (b *bot) delSubmissionsCallback(m *tgbotapi.Message) {
+	b.delSubmissions(m.From, m.Text)
+}
+
+func (b *bot) delSubmissions(u *tgbotapi.User, faUser string) {
 	logger := log.WithFields(log.Fields{
-		"func":     "delSubmissionsCallback",
-		"userID":   m.From.ID,
-		"username": m.From.UserName,
+		"func":     "delSubmissions",
+		"userID":   u.ID,
+		"username": u.UserName,
 	})
 
-	err := b.db.DeleteUserSubmissionsForUser(db.TelegramID(m.From.ID), m.Text)
+	err := b.db.DeleteUserSubmissionsForUser(db.TelegramID(u.ID), faUser)
 	switch err {
 	case db.ErrNoFAUser:
-		b.sendMessage(m.From.ID, "I couldn't find that user.")
+		b.sendMessage(u.ID, "I couldn't find that user.")
 	case nil:
-		b.sendHTMLMessage(m.From.ID, "I will no longer alert you to any new submissions from <code>%s</code>.", m.Text)
+		b.sendHTMLMessage(u.ID, "I will no longer alert you to any new submissions from <code>%s</code>.",
+			escapeHTML(faUser))
 	default:
 		logger.WithError(err).Error("Unable to delete submissions for user")
-		b.sendMessage(m.From.ID, fmt.Sprintf(saveFailedFormat, "user submission alert deletion"))
+		b.sendMessage(u.ID, fmt.Sprintf(saveFailedFormat, "user submission alert deletion"))
 	}
 }
@@ -0,0 +1,12 @@
+module github.com/ajanata/faapi
+
+go 1.16
+
+require (
+	github.com/PuerkitoBio/rehttp v0.0.0-20180310210549-11cf6ea5d3e9
+	github.com/sirupsen/logrus v1.2.0
+	golang.org/x/crypto v0.0.0-20181112202954-3d3f9f413869 // indirect
+	golang.org/x/net v0.0.0-20181005035420-146acd28ed58
+	golang.org/x/sys v0.0.0-20181116161606-93218def8b18 // indirect
+
+)